@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+var knownScopes = []string{
+	auth.ScopeChirpsRead,
+	auth.ScopeChirpsWrite,
+	auth.ScopeAccountRead,
+	auth.ScopeAccountWrite,
+	auth.ScopeAdmin,
+}
+
+type accessTokenReq struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type accessTokenDto struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Token      string     `json:"token,omitempty"`
+	ID         int        `json:"id"`
+}
+
+func newAccessTokenDto(accessToken database.AccessToken) accessTokenDto {
+	return accessTokenDto{
+		ID:         accessToken.ID,
+		Name:       accessToken.Name,
+		Scopes:     accessToken.Scopes,
+		CreatedAt:  accessToken.CreatedAt,
+		LastUsedAt: accessToken.LastUsedAt,
+		ExpiresAt:  accessToken.ExpiresAt,
+	}
+}
+
+func (cfg *apiConfig) createAccessToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	var req accessTokenReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	if req.Name == "" || len(req.Scopes) == 0 {
+		respondWithError(w, http.StatusBadRequest, "name and scopes are required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(knownScopes, scope) {
+			respondWithError(w, http.StatusBadRequest, "unknown scope "+strconv.Quote(scope))
+			return
+		}
+		// an access token can't mint one that's allowed more than itself
+		if !caller.allows(scope) {
+			respondForbiddenScope(w, scope)
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		respondWithError(w, http.StatusBadRequest, "expires_at must be in the future")
+		return
+	}
+
+	token, err := auth.GenerateAccessToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	accessToken, err := cfg.db.CreateAccessToken(caller.UserID, req.Name, token, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// the token is only ever shown here, we just keep its hash
+	response := newAccessTokenDto(accessToken)
+	response.Token = token
+	respondWithJSON(w, http.StatusCreated, response)
+}
+
+func (cfg *apiConfig) listAccessTokens(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	accessTokens, err := cfg.db.ListAccessTokens(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := make([]accessTokenDto, 0, len(accessTokens))
+	for _, accessToken := range accessTokens {
+		response = append(response, newAccessTokenDto(accessToken))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) revokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.db.RevokeAccessToken(id, caller.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
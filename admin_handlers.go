@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+var knownRoles = []string{database.RoleUser, database.RoleModerator, database.RoleAdmin}
+
+type rolesReq struct {
+	Roles []string `json:"roles"`
+}
+
+func (cfg *apiConfig) setUserRoles(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var req rolesReq
+
+	decoder := json.NewDecoder(r.Body)
+	err = decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	// every user keeps the user role, whatever else they're given
+	roles := []string{database.RoleUser}
+	for _, role := range req.Roles {
+		if !slices.Contains(knownRoles, role) {
+			respondWithError(w, http.StatusBadRequest, "unknown role "+strconv.Quote(role))
+			return
+		}
+		if !slices.Contains(roles, role) {
+			roles = append(roles, role)
+		}
+	}
+
+	dbUser, err := cfg.db.SetUserRoles(id, roles)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := userDto{
+		ID:          dbUser.ID,
+		CreatedAt:   &dbUser.CreatedAt,
+		UpdatedAt:   &dbUser.UpdatedAt,
+		Email:       &dbUser.Email,
+		Roles:       dbUser.Roles,
+		IsChirpyRed: dbUser.IsChirpyRed(),
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) unlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("userID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.db.ResetLoginFailures(id)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.loginEmails.reset(emailKey(dbUser.Email))
+
+	cfg.audit(r, auditAccountUnlocked, id, 0)
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) unlockIP(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.PathValue("ip"))
+	if ip == nil {
+		respondWithError(w, http.StatusBadRequest, "invalid IP address")
+		return
+	}
+
+	if !cfg.loginIPs.reset(ip.String()) {
+		respondWithError(w, http.StatusNotFound, "no failed logins from this IP")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) removeChirp(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.db.RemoveChirpByID(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
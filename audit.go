@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const auditRefreshTokenReused = "refresh_token_reused"
+
+// audit records a security event about the request. A failure to write
+// it is logged rather than failing the request, which already has an answer.
+func (cfg *apiConfig) audit(r *http.Request, eventType string, userID, sessionID int) {
+	event, err := cfg.db.RecordAuditEvent(database.AuditEvent{
+		Type:      eventType,
+		UserID:    userID,
+		SessionID: sessionID,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	})
+	if err != nil {
+		log.Printf("Error recording audit event %s for user %d: %s", eventType, userID, err)
+		return
+	}
+
+	log.Printf("audit: %s user=%d session=%d ip=%s", event.Type, event.UserID, event.SessionID, event.IP)
+}
@@ -1,52 +1,65 @@
 package main
 
 import (
+	"errors"
 	"net/http"
-	"strings"
 
 	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
 )
 
 func (cfg *apiConfig) refreshToken(w http.ResponseWriter, r *http.Request) {
-	authReqHeader := r.Header.Get("Authorization")
+	tokenStr, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	if authReqHeader == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	refreshToken, err := auth.GenerateRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	tokenStr := strings.Split(authReqHeader, " ")[1]
+	dbToken, err := cfg.db.RotateToken(tokenStr, refreshToken.Token, refreshToken.TokenExpDate)
+	if err != nil {
+		if errors.Is(err, database.ErrTokenReused) {
+			// someone is holding a copy of a token that was already
+			// exchanged, the session is gone so neither copy works now
+			cfg.audit(r, auditRefreshTokenReused, dbToken.UserID, dbToken.SessionID)
+		}
+		respondWithError(w, http.StatusUnauthorized, "")
+		return
+	}
 
-	dbToken, err := cfg.db.GetToken(tokenStr)
+	dbUser, err := cfg.db.GetUserByID(dbToken.UserID)
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "")
 		return
 	}
 
-	signedToken, err := auth.IssueJWT(dbToken.UserID, cfg.jwtSecret)
+	signedToken, err := auth.IssueJWT(dbUser.ID, dbUser.Roles, cfg.jwtKeys)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	response := tokenDto{
-		Token: signedToken,
+		Token:        signedToken,
+		RefreshToken: refreshToken.Token,
 	}
 
 	respondWithJSON(w, http.StatusOK, response)
 }
 
 func (cfg *apiConfig) revokeToken(w http.ResponseWriter, r *http.Request) {
-	authReqHeader := r.Header.Get("Authorization")
-
-	if authReqHeader == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	tokenStr, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	tokenStr := strings.Split(authReqHeader, " ")[1]
-
-	err := cfg.db.RevokeToken(tokenStr)
+	err = cfg.db.RevokeToken(tokenStr)
 	if err != nil {
 		respondWithJSON(w, http.StatusNoContent, nil)
 		return
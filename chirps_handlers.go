@@ -3,19 +3,36 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"github.com/luispinto23/chirpy-new/internal/auth"
 	"github.com/luispinto23/chirpy-new/internal/database"
 )
 
+const (
+	defaultChirpsLimit = 50
+	maxChirpsLimit     = 100
+
+	// chirpPurgeInterval is how often soft deleted chirps
+	// past their restore period are removed
+	chirpPurgeInterval = time.Hour
+)
+
 type chirpDto struct {
 	Body *string `json:"body,omitempty"`
+	// PublishAt schedules the chirp instead of posting it right away
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+}
+
+type chirpsPageDto struct {
+	Chirps     []database.Chirp `json:"chirps"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
 func cleanUpBody(body string) string {
@@ -36,30 +53,83 @@ func cleanUpBody(body string) string {
 }
 
 func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
-	authReqHeader := r.Header.Get("Authorization")
+	caller, _ := principalFromContext(r.Context())
 
-	if authReqHeader == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	var chirp chirpDto
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&chirp)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
 		return
 	}
 
-	tokenStr := strings.Split(authReqHeader, " ")[1]
+	if chirp.Body == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
-	token, err := auth.ValidateJWTToken(tokenStr, cfg.jwtSecret)
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ent := entitlementsOf(dbUser)
+
+	if len(*chirp.Body) > ent.MaxChirpLength {
+		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
+	now := time.Now()
+	if chirp.PublishAt != nil {
+		if !ent.ScheduleChirps {
+			respondWithError(w, http.StatusForbidden, "scheduling chirps requires Chirpy Red")
+			return
+		}
+		if !chirp.PublishAt.After(now) || chirp.PublishAt.After(now.Add(ent.ScheduleHorizon)) {
+			respondWithError(w, http.StatusBadRequest,
+				fmt.Sprintf("publish_at must be in the next %s", ent.ScheduleHorizon))
+			return
+		}
+	}
+
+	wait, ok := cfg.chirpRates.allow(caller.UserID, ent.ChirpsPerHour, now)
 	if !ok {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse claims")
+		respondRateLimited(w, wait, "too many chirps, try again later")
+		return
+	}
+
+	cleanBody := cleanUpBody(*chirp.Body)
+
+	if chirp.PublishAt != nil {
+		scheduled, err := cfg.db.ScheduleChirp(cleanBody, caller.UserID, *chirp.PublishAt)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusAccepted, scheduled)
 		return
 	}
 
-	userID, err := claims.GetSubject()
+	dbChirp, err := cfg.db.CreateChirp(cleanBody, caller.UserID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, dbChirp)
+}
+
+func (cfg *apiConfig) editChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("chirpID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -79,33 +149,45 @@ func (cfg *apiConfig) createChirp(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(*chirp.Body) > 140 {
-		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	ent := entitlementsOf(dbUser)
 
-	cleanBody := cleanUpBody(*chirp.Body)
-	intUserID, err := strconv.Atoi(userID)
-	if err != nil {
-		log.Printf("Error parsing user id: %s", err)
+	if !ent.EditChirps {
+		respondWithError(w, http.StatusForbidden, "editing chirps requires Chirpy Red")
+		return
+	}
 
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+	if len(*chirp.Body) > ent.MaxChirpLength {
+		respondWithError(w, http.StatusBadRequest, "Chirp is too long")
 		return
 	}
 
-	dbChirp, err := cfg.db.CreateChirp(cleanBody, intUserID)
+	dbChirp, err := cfg.db.UpdateChirp(id, caller.UserID, cleanUpBody(*chirp.Body))
 	if err != nil {
+		if errors.Is(err, database.ErrUnauthorized) {
+			respondWithError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, dbChirp)
+	respondWithJSON(w, http.StatusOK, dbChirp)
 }
 
 func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
-	authorID := r.URL.Query().Get("author_id")
+	query := r.URL.Query()
+	authorID := query.Get("author_id")
 	var intAuthorID int
-	sort := r.URL.Query().Get("sort")
+	sort := query.Get("sort")
 	var err error
 	if authorID != "" {
 		intAuthorID, err = strconv.Atoi(authorID)
@@ -115,13 +197,72 @@ func (cfg *apiConfig) getChirps(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	dbChirps, err := cfg.db.GetChirps(intAuthorID, sort)
+	// pages are opt-in, clients that ask for neither a limit nor a
+	// cursor keep getting every chirp as a plain array
+	paged := query.Has("limit") || query.Has("cursor")
+
+	limit := 0
+	if paged {
+		limit = defaultChirpsLimit
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxChirpsLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxChirpsLimit))
+			return
+		}
+	}
+
+	var since, until time.Time
+	if sinceStr := query.Get("since"); sinceStr != "" {
+		since, err = time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+			return
+		}
+	}
+	if untilStr := query.Get("until"); untilStr != "" {
+		until, err = time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "until must be an RFC 3339 timestamp")
+			return
+		}
+	}
+
+	page, err := cfg.db.GetChirps(database.ChirpsQuery{
+		AuthorID: intAuthorID,
+		Sort:     sort,
+		Limit:    limit,
+		Cursor:   query.Get("cursor"),
+		Since:    since,
+		Until:    until,
+	})
 	if err != nil {
+		if errors.Is(err, database.ErrInvalidCursor) {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, "Failed to retrieve chirps")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, dbChirps)
+	if page.NextCursor != "" {
+		query.Set("cursor", page.NextCursor)
+		query.Set("limit", strconv.Itoa(limit))
+		next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, next.String()))
+	}
+
+	if !paged {
+		respondWithJSON(w, http.StatusOK, page.Chirps)
+		return
+	}
+
+	response := chirpsPageDto{
+		Chirps:     page.Chirps,
+		NextCursor: page.NextCursor,
+	}
+	respondWithJSON(w, http.StatusOK, response)
 }
 
 func (cfg *apiConfig) getChirp(w http.ResponseWriter, r *http.Request) {
@@ -145,54 +286,72 @@ func (cfg *apiConfig) getChirp(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *apiConfig) deleteChirp(w http.ResponseWriter, r *http.Request) {
-	authReqHeader := r.Header.Get("Authorization")
+	caller, _ := principalFromContext(r.Context())
 
-	if authReqHeader == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	tokenStr := strings.Split(authReqHeader, " ")[1]
-
-	token, err := auth.ValidateJWTToken(tokenStr, cfg.jwtSecret)
+	id, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse claims")
-		return
+	if cfg.chirpRestoreGrace > 0 {
+		err = cfg.db.SoftDeleteChirpByID(id, caller.UserID)
+	} else {
+		err = cfg.db.DeleteChirpByID(id, caller.UserID)
 	}
-
-	userID, err := claims.GetSubject()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		if errors.Is(err, database.ErrUnauthorized) {
+			respondWithError(w, http.StatusForbidden, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) restoreChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
 	id, err := strconv.Atoi(r.PathValue("chirpID"))
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	intUserID, err := strconv.Atoi(userID)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	err = cfg.db.DeleteChirpByID(id, intUserID)
+	dbChirp, err := cfg.db.RestoreChirpByID(id, caller.UserID, cfg.chirpRestoreGrace)
 	if err != nil {
 		if errors.Is(err, database.ErrUnauthorized) {
 			respondWithError(w, http.StatusForbidden, err.Error())
 			return
 		}
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrExpired) {
+			respondWithError(w, http.StatusGone, "restore period is over")
+			return
+		}
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusNoContent, nil)
+	respondWithJSON(w, http.StatusOK, dbChirp)
+}
+
+// purgeDeletedChirps removes the soft deleted chirps that can't be
+// restored anymore. Without a restore period that's all of them.
+func (cfg *apiConfig) purgeDeletedChirps(now time.Time) {
+	n, err := cfg.db.PurgeDeletedChirps(now.Add(-cfg.chirpRestoreGrace))
+	if err != nil {
+		log.Printf("Error purging deleted chirps: %s", err)
+	} else if n > 0 {
+		log.Printf("purged %d deleted chirps", n)
+	}
 }
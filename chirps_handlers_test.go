@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+// storeDrivers are the DB_DRIVERs the handler tests run against
+var storeDrivers = []string{"json", "sqlite"}
+
+func openTestStore(t *testing.T, driver string) database.Store {
+	t.Helper()
+
+	db, err := openStore(driver, filepath.Join(t.TempDir(), "database"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("openStore(%s): %s", driver, err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// getChirps calls the getChirps handler with query
+func getChirps(t *testing.T, cfg *apiConfig, query url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, "/api/chirps?"+query.Encode(), nil)
+	w := httptest.NewRecorder()
+	cfg.getChirps(w, r)
+	return w
+}
+
+func chirpIDs(chirps []database.Chirp) []int {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	return ids
+}
+
+var nextLink = regexp.MustCompile(`^<(.+)>; rel="next"$`)
+
+func TestGetChirpsPages(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver, func(t *testing.T) {
+			cfg := &apiConfig{db: openTestStore(t, driver)}
+
+			user, err := cfg.db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			for i := range 5 {
+				_, err = cfg.db.CreateChirp("chirp "+strconv.Itoa(i), user.ID)
+				if err != nil {
+					t.Fatalf("CreateChirp: %s", err)
+				}
+			}
+
+			// pages follows the Link headers from the first page on
+			pages := func(query url.Values) [][]int {
+				var pages [][]int
+				for range 10 {
+					w := getChirps(t, cfg, query)
+					if w.Code != http.StatusOK {
+						t.Fatalf("GET %s: status = %d, want %d", query.Encode(), w.Code, http.StatusOK)
+					}
+					var page chirpsPageDto
+					err := json.Unmarshal(w.Body.Bytes(), &page)
+					if err != nil {
+						t.Fatalf("GET %s: decoding %s: %s", query.Encode(), w.Body, err)
+					}
+					pages = append(pages, chirpIDs(page.Chirps))
+
+					link := w.Header().Get("Link")
+					if link == "" {
+						if page.NextCursor != "" {
+							t.Errorf("GET %s: next_cursor without a Link header", query.Encode())
+						}
+						return pages
+					}
+					m := nextLink.FindStringSubmatch(link)
+					if m == nil {
+						t.Fatalf("GET %s: Link = %q", query.Encode(), link)
+					}
+					next, err := url.Parse(m[1])
+					if err != nil {
+						t.Fatalf("GET %s: Link = %q: %s", query.Encode(), link, err)
+					}
+					if next.Path != "/api/chirps" {
+						t.Errorf("GET %s: Link path = %q, want /api/chirps", query.Encode(), next.Path)
+					}
+					query = next.Query()
+					if query.Get("cursor") != page.NextCursor {
+						t.Errorf("Link cursor = %q, want next_cursor %q", query.Get("cursor"), page.NextCursor)
+					}
+				}
+				t.Fatalf("more than 10 pages")
+				return nil
+			}
+
+			tests := []struct {
+				query url.Values
+				want  [][]int
+			}{
+				{query: url.Values{"limit": {"2"}}, want: [][]int{{1, 2}, {3, 4}, {5}}},
+				{query: url.Values{"limit": {"2"}, "sort": {"desc"}}, want: [][]int{{5, 4}, {3, 2}, {1}}},
+				// a last page that is exactly full has no next page
+				{query: url.Values{"limit": {"5"}}, want: [][]int{{1, 2, 3, 4, 5}}},
+				{query: url.Values{"limit": {"4"}}, want: [][]int{{1, 2, 3, 4}, {5}}},
+				{query: url.Values{"limit": {"1"}, "author_id": {strconv.Itoa(user.ID)}}, want: [][]int{{1}, {2}, {3}, {4}, {5}}},
+				{query: url.Values{"limit": {"2"}, "author_id": {strconv.Itoa(user.ID + 1)}}, want: [][]int{{}}},
+				// a cursor without a limit gets the default one
+				{query: url.Values{"cursor": {cursor("asc", 3)}}, want: [][]int{{4, 5}}},
+			}
+			for _, tt := range tests {
+				if got := pages(tt.query); !slices.EqualFunc(got, tt.want, slices.Equal) {
+					t.Errorf("pages of %s = %v, want %v", tt.query.Encode(), got, tt.want)
+				}
+			}
+
+			// without a limit or cursor it's every chirp as a plain array
+			w := getChirps(t, cfg, url.Values{})
+			var chirps []database.Chirp
+			err = json.Unmarshal(w.Body.Bytes(), &chirps)
+			if err != nil {
+				t.Fatalf("GET without a page: decoding %s: %s", w.Body, err)
+			}
+			if got := chirpIDs(chirps); !slices.Equal(got, []int{1, 2, 3, 4, 5}) {
+				t.Errorf("GET without a page = %v, want every chirp", got)
+			}
+			if link := w.Header().Get("Link"); link != "" {
+				t.Errorf("GET without a page: Link = %q, want none", link)
+			}
+
+			invalid := []url.Values{
+				{"limit": {"0"}},
+				{"limit": {strconv.Itoa(maxChirpsLimit + 1)}},
+				{"limit": {"two"}},
+				{"cursor": {"not a cursor"}},
+				{"cursor": {cursor("asc", 0)}},
+				{"cursor": {base64.RawURLEncoding.EncodeToString([]byte("asc"))}},
+				// a cursor only continues the order it was made for
+				{"cursor": {cursor("asc", 2)}, "sort": {"desc"}},
+			}
+			for _, query := range invalid {
+				if w := getChirps(t, cfg, query); w.Code != http.StatusBadRequest {
+					t.Errorf("GET %s: status = %d, want %d", query.Encode(), w.Code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+}
+
+// cursor makes the cursor of a page ending at lastID
+func cursor(sort string, lastID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(sort + ":" + strconv.Itoa(lastID)))
+}
+
+func TestGetChirpsTimeRange(t *testing.T) {
+	for _, driver := range storeDrivers {
+		t.Run(driver, func(t *testing.T) {
+			cfg := &apiConfig{db: openTestStore(t, driver)}
+
+			user, err := cfg.db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			var created []time.Time
+			for i := range 3 {
+				if i > 0 {
+					// every chirp at its own instant
+					time.Sleep(time.Millisecond)
+				}
+				chirp, err := cfg.db.CreateChirp("chirp "+strconv.Itoa(i), user.ID)
+				if err != nil {
+					t.Fatalf("CreateChirp: %s", err)
+				}
+				created = append(created, chirp.CreatedAt)
+			}
+			at := func(i int) string {
+				return created[i].Format(time.RFC3339Nano)
+			}
+
+			tests := []struct {
+				query url.Values
+				want  []int
+			}{
+				// since is inclusive, until exclusive
+				{query: url.Values{"since": {at(1)}}, want: []int{2, 3}},
+				{query: url.Values{"until": {at(1)}}, want: []int{1}},
+				{query: url.Values{"since": {at(0)}, "until": {at(2)}}, want: []int{1, 2}},
+				{query: url.Values{"since": {at(1)}, "until": {at(1)}}, want: []int{}},
+				{query: url.Values{"since": {created[2].Add(time.Nanosecond).Format(time.RFC3339Nano)}}, want: []int{}},
+				// other offsets name the same instants
+				{query: url.Values{"since": {created[1].In(time.FixedZone("", -5*60*60)).Format(time.RFC3339Nano)}}, want: []int{2, 3}},
+				// the filters apply before the page is cut
+				{query: url.Values{"since": {at(1)}, "limit": {"1"}}, want: []int{2}},
+				{query: url.Values{"until": {at(2)}, "sort": {"desc"}, "limit": {"1"}}, want: []int{2}},
+			}
+			for _, tt := range tests {
+				w := getChirps(t, cfg, tt.query)
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s: status = %d, want %d", tt.query.Encode(), w.Code, http.StatusOK)
+					continue
+				}
+
+				var chirps []database.Chirp
+				if tt.query.Has("limit") {
+					var page chirpsPageDto
+					err = json.Unmarshal(w.Body.Bytes(), &page)
+					chirps = page.Chirps
+				} else {
+					err = json.Unmarshal(w.Body.Bytes(), &chirps)
+				}
+				if err != nil {
+					t.Fatalf("GET %s: decoding %s: %s", tt.query.Encode(), w.Body, err)
+				}
+				if got := chirpIDs(chirps); !slices.Equal(got, tt.want) {
+					t.Errorf("GET %s = %v, want %v", tt.query.Encode(), got, tt.want)
+				}
+			}
+
+			invalid := []url.Values{
+				{"since": {"yesterday"}},
+				{"until": {"2024-01-02"}},
+			}
+			for _, query := range invalid {
+				if w := getChirps(t, cfg, query); w.Code != http.StatusBadRequest {
+					t.Errorf("GET %s: status = %d, want %d", query.Encode(), w.Code, http.StatusBadRequest)
+				}
+			}
+		})
+	}
+}
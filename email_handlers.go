@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+	"github.com/luispinto23/chirpy-new/internal/mail"
+)
+
+const (
+	auditPasswordReset = "password_reset"
+
+	errResetThrottled = "too many password reset requests, try again later"
+)
+
+var (
+	// resetEmailBackoff lets an email ask for a few password resets,
+	// then doubles the wait after each further request
+	resetEmailBackoff = backoff{free: 3, base: time.Minute, max: time.Hour}
+	// resetIPBackoff is more lenient since many users can share an IP
+	resetIPBackoff = backoff{free: 10, base: time.Minute, max: time.Hour}
+)
+
+type actionTokenReq struct {
+	Email    string `json:"email,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// verifyEmailState changes once the email is verified or replaced,
+// which spends every verification token sent before
+func verifyEmailState(user database.User) string {
+	return user.Email + "|" + strconv.FormatBool(user.EmailVerified)
+}
+
+// passwordResetState changes with the password, which spends
+// every reset token sent before
+func passwordResetState(user database.User) string {
+	return user.Password
+}
+
+// actionLink returns the link to the app page completing an action,
+// or just the token when no app URL is configured
+func (cfg *apiConfig) actionLink(page, token string) string {
+	if cfg.appBaseURL == "" {
+		return token
+	}
+	return cfg.appBaseURL + "/" + page + "?token=" + url.QueryEscape(token)
+}
+
+func (cfg *apiConfig) verificationMessage(dbUser database.User) (mail.Message, error) {
+	token, err := auth.IssueActionToken(dbUser.ID, auth.PurposeVerifyEmail, verifyEmailState(dbUser), auth.VerifyEmailExpiration, cfg.jwtKeys)
+	if err != nil {
+		return mail.Message{}, err
+	}
+
+	return mail.Message{
+		To:      dbUser.Email,
+		Subject: "Verify your Chirpy email",
+		Body: fmt.Sprintf("Confirm this is your email with:\n\n%s\n\nIt expires in %s.\n",
+			cfg.actionLink("verify-email", token), auth.VerifyEmailExpiration),
+	}, nil
+}
+
+// sendMailLater sends msg in the background, so the response doesn't
+// wait on the mail server or reveal by its timing whether it was sent
+func (cfg *apiConfig) sendMailLater(msg mail.Message) {
+	cfg.jobs.Add(1)
+	go func() {
+		defer cfg.jobs.Done()
+
+		err := cfg.mailer.Send(msg)
+		if err != nil {
+			log.Printf("Error sending %q: %s", msg.Subject, err)
+		}
+	}()
+}
+
+func (cfg *apiConfig) requestEmailVerification(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if dbUser.EmailVerified {
+		respondWithError(w, http.StatusConflict, "email is already verified")
+		return
+	}
+
+	msg, err := cfg.verificationMessage(dbUser)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.mailer.Send(msg)
+	if err != nil {
+		log.Printf("Error sending verification email: %s", err)
+
+		respondWithError(w, http.StatusBadGateway, "couldn't send the email")
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (cfg *apiConfig) confirmEmailVerification(w http.ResponseWriter, r *http.Request) {
+	var req actionTokenReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	userID, err := auth.ValidateActionToken(req.Token, auth.PurposeVerifyEmail, cfg.jwtKeys, cfg.userState(verifyEmailState))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+
+	_, err = cfg.db.MarkEmailVerified(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req actionTokenReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	if req.Email == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// unknown emails are throttled too, so a 429 doesn't tell which exist
+	if !reserveAttempt(w, r, cfg.resetIPs, cfg.resetEmails, req.Email, errResetThrottled) {
+		return
+	}
+
+	// the answer is the same whether the email exists or not, and as
+	// quick, since looking it up and sending the mail happen later
+	cfg.sendPasswordResetLater(req.Email)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendPasswordResetLater sends a password reset link to the user of
+// email in the background, if there is one
+func (cfg *apiConfig) sendPasswordResetLater(email string) {
+	cfg.jobs.Add(1)
+	go func() {
+		defer cfg.jobs.Done()
+
+		dbUser, err := cfg.db.GetUser(email)
+		if err != nil {
+			if !errors.Is(err, database.ErrNotFound) {
+				log.Printf("Error looking up %s for a password reset: %s", email, err)
+			}
+			return
+		}
+
+		token, err := auth.IssueActionToken(dbUser.ID, auth.PurposePasswordReset, passwordResetState(dbUser), auth.PasswordResetExpiration, cfg.jwtKeys)
+		if err != nil {
+			log.Printf("Error issuing password reset token: %s", err)
+			return
+		}
+
+		msg := mail.Message{
+			To:      dbUser.Email,
+			Subject: "Reset your Chirpy password",
+			Body: fmt.Sprintf("Someone asked to reset your password. If it was you, continue with:\n\n%s\n\n"+
+				"It expires in %s. If it wasn't you, you can ignore this email.\n",
+				cfg.actionLink("reset-password", token), auth.PasswordResetExpiration),
+		}
+		err = cfg.mailer.Send(msg)
+		if err != nil {
+			log.Printf("Error sending %q: %s", msg.Subject, err)
+		}
+	}()
+}
+
+func (cfg *apiConfig) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req actionTokenReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	if req.Password == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = cfg.passwordPolicy.Check(req.Password)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// the user is kept as the token was checked against, the reset
+	// only goes through if their password is still the same
+	var dbUser database.User
+	_, err = auth.ValidateActionToken(req.Token, auth.PurposePasswordReset, cfg.jwtKeys, func(userID int) (string, error) {
+		var err error
+		dbUser, err = cfg.db.GetUserByID(userID)
+		if err != nil {
+			return "", err
+		}
+		return passwordResetState(dbUser), nil
+	})
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+
+	pass, err := cfg.passwords.Hash(req.Password)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// whoever knew the old password shouldn't stay logged in
+	err = cfg.db.ResetPassword(dbUser.ID, dbUser.Password, pass)
+	if errors.Is(err, database.ErrNotFound) {
+		// another reset with the same token got there first
+		respondWithError(w, http.StatusBadRequest, "invalid or expired token")
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cfg.audit(r, auditPasswordReset, dbUser.ID, 0)
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// userState adapts a state function to what auth.ValidateActionToken looks up
+func (cfg *apiConfig) userState(state func(database.User) string) func(userID int) (string, error) {
+	return func(userID int) (string, error) {
+		dbUser, err := cfg.db.GetUserByID(userID)
+		if err != nil {
+			return "", err
+		}
+		return state(dbUser), nil
+	}
+}
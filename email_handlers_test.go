@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+	"github.com/luispinto23/chirpy-new/internal/mail"
+)
+
+func TestPasswordResetThrottled(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	user, err := db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+
+	cfg := &apiConfig{
+		db:          db,
+		jwtKeys:     auth.NewHMACKeySet("secret"),
+		mailer:      mail.NewLogMailer(io.Discard, "no-reply@localhost"),
+		resetIPs:    newLoginThrottle(resetIPBackoff),
+		resetEmails: newLoginThrottle(resetEmailBackoff),
+	}
+	// the mails are sent in the background, before the store is closed
+	t.Cleanup(cfg.jobs.Wait)
+
+	requestReset := func(email, ip string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/password-reset", strings.NewReader(`{"email":"`+email+`"}`))
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		cfg.requestPasswordReset(w, r)
+		return w.Code
+	}
+
+	// known and unknown emails are throttled alike
+	for _, email := range []string{user.Email, "nobody@b.com"} {
+		for i := range resetEmailBackoff.free {
+			if code := requestReset(email, "10.0.0.1"); code != http.StatusAccepted {
+				t.Fatalf("request %d for %s: status = %d, want %d", i, email, code, http.StatusAccepted)
+			}
+		}
+		if code := requestReset(email, "10.0.0.2"); code != http.StatusTooManyRequests {
+			t.Errorf("request past the limit for %s: status = %d, want %d", email, code, http.StatusTooManyRequests)
+		}
+	}
+
+	// the first IP asked for 6 resets, a few more emails use it up
+	for i := 2 * resetEmailBackoff.free; i < resetIPBackoff.free; i++ {
+		if code := requestReset(fmt.Sprintf("other%d@b.com", i), "10.0.0.1"); code != http.StatusAccepted {
+			t.Fatalf("request %d from the IP: status = %d, want %d", i, code, http.StatusAccepted)
+		}
+	}
+	if code := requestReset("fresh@b.com", "10.0.0.1"); code != http.StatusTooManyRequests {
+		t.Errorf("request past the IP limit: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestPasswordResetConfirm(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	passwords, err := auth.NewPasswordHasher(auth.HashBcrypt, 4, auth.DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher: %s", err)
+	}
+	policy, err := auth.NewPasswordPolicy(8, 72, "")
+	if err != nil {
+		t.Fatalf("NewPasswordPolicy: %s", err)
+	}
+	cfg := &apiConfig{
+		db:             db,
+		jwtKeys:        auth.NewHMACKeySet("secret"),
+		passwords:      passwords,
+		passwordPolicy: policy,
+	}
+
+	hash, err := passwords.Hash("old password")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	user, err := db.CreateUser("a@b.com", hash)
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	_, _, err = db.CreateSession(user.ID, "browser", "127.0.0.1", "refresh", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("CreateSession: %s", err)
+	}
+	_, err = db.CreateAccessToken(user.ID, "bot", "pat", []string{"chirps:write"}, nil)
+	if err != nil {
+		t.Fatalf("CreateAccessToken: %s", err)
+	}
+
+	token, err := auth.IssueActionToken(user.ID, auth.PurposePasswordReset, passwordResetState(user), auth.PasswordResetExpiration, cfg.jwtKeys)
+	if err != nil {
+		t.Fatalf("IssueActionToken: %s", err)
+	}
+	confirm := func(password string) int {
+		body := `{"token":"` + token + `","password":"` + password + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/api/password-reset/confirm", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		cfg.confirmPasswordReset(w, r)
+		return w.Code
+	}
+
+	if code := confirm("new password"); code != http.StatusNoContent {
+		t.Fatalf("reset: status = %d, want %d", code, http.StatusNoContent)
+	}
+	_, err = db.GetToken("refresh")
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("GetToken after the reset: err = %v, want ErrNotFound", err)
+	}
+	_, err = db.UseAccessToken("pat")
+	if !errors.Is(err, database.ErrNotFound) {
+		t.Errorf("UseAccessToken after the reset: err = %v, want ErrNotFound", err)
+	}
+
+	// the token was spent with the old password
+	if code := confirm("other password"); code != http.StatusBadRequest {
+		t.Errorf("second reset with the token: status = %d, want %d", code, http.StatusBadRequest)
+	}
+	reset, err := db.GetUserByID(user.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %s", err)
+	}
+	if _, err := passwords.Verify(reset.Password, "new password"); err != nil {
+		t.Errorf("password after the reset: %s", err)
+	}
+}
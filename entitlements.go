@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+// planFree is the plan of users without an active subscription
+const planFree = "free"
+
+// entitlements are what a plan lets its users do
+type entitlements struct {
+	// MaxChirpLength is the longest chirp body, in bytes
+	MaxChirpLength int
+	// EditChirps allows changing the body of a posted chirp
+	EditChirps bool
+	// ScheduleChirps allows posting chirps that are published later,
+	// at most ScheduleHorizon ahead
+	ScheduleChirps  bool
+	ScheduleHorizon time.Duration
+	// ChirpsPerHour is how many chirps can be posted or scheduled
+	// in any hour, 0 for no limit
+	ChirpsPerHour int
+}
+
+// planEntitlements holds the perks of every plan. Handlers only ever
+// ask entitlementsOf, so this is the one place to change them.
+var planEntitlements = map[string]entitlements{
+	planFree: {
+		MaxChirpLength: 140,
+		ChirpsPerHour:  30,
+	},
+	database.PlanChirpyRed: {
+		MaxChirpLength:  1000,
+		EditChirps:      true,
+		ScheduleChirps:  true,
+		ScheduleHorizon: 30 * 24 * time.Hour,
+		ChirpsPerHour:   300,
+	},
+}
+
+// entitlementsOf returns what the plan of user lets them do. Lapsed
+// subscriptions and plans without entitlements fall back to free.
+func entitlementsOf(user database.User) entitlements {
+	plan := planFree
+	if user.Subscription != nil && user.Subscription.Active(time.Now()) {
+		plan = user.Subscription.Plan
+	}
+
+	ent, ok := planEntitlements[plan]
+	if !ok {
+		return planEntitlements[planFree]
+	}
+	return ent
+}
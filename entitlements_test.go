@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+func TestEntitlementsOf(t *testing.T) {
+	now := time.Now()
+	later := now.Add(time.Hour)
+	earlier := now.Add(-time.Hour)
+
+	tests := []struct {
+		name string
+		sub  *database.Subscription
+		want string
+	}{
+		{name: "never subscribed", want: planFree},
+		{name: "active", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionActive, CurrentPeriodEnd: later}, want: database.PlanChirpyRed},
+		{name: "active past its period", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionActive, CurrentPeriodEnd: earlier}, want: planFree},
+		{name: "cancelled within its period", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionCancelled, CurrentPeriodEnd: later}, want: database.PlanChirpyRed},
+		{name: "past due in grace", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionPastDue, CurrentPeriodEnd: earlier, GracePeriodEnd: &later}, want: database.PlanChirpyRed},
+		{name: "past due after grace", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionPastDue, CurrentPeriodEnd: earlier, GracePeriodEnd: &earlier}, want: planFree},
+		{name: "expired", sub: &database.Subscription{Plan: database.PlanChirpyRed, Status: database.SubscriptionExpired, CurrentPeriodEnd: later}, want: planFree},
+		{name: "plan without entitlements", sub: &database.Subscription{Plan: "chirpy_gold", Status: database.SubscriptionActive, CurrentPeriodEnd: later}, want: planFree},
+	}
+
+	for _, tt := range tests {
+		got := entitlementsOf(database.User{Subscription: tt.sub})
+		if got != planEntitlements[tt.want] {
+			t.Errorf("%s: entitlements = %+v, want those of %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEntitlementGates(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	cfg := &apiConfig{db: db, chirpRates: newRateLimiter(time.Hour)}
+
+	plans := map[string]int{}
+	for _, plan := range []string{planFree, database.PlanChirpyRed} {
+		user, err := db.CreateUser(plan+"@b.com", "hash")
+		if err != nil {
+			t.Fatalf("CreateUser: %s", err)
+		}
+		plans[plan] = user.ID
+	}
+	_, err = db.UpdateSubscription(plans[database.PlanChirpyRed], func(sub *database.Subscription) error {
+		sub.Plan = database.PlanChirpyRed
+		sub.Status = database.SubscriptionActive
+		sub.CurrentPeriodEnd = time.Now().Add(database.SubscriptionPeriod)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %s", err)
+	}
+
+	// post calls handler as the user on plan with a chirp body of
+	// length bytes, scheduled publishIn from now unless it's 0
+	post := func(plan string, handler http.HandlerFunc, chirpID, length int, publishIn time.Duration) int {
+		chirp := map[string]any{"body": strings.Repeat("a", length)}
+		if publishIn != 0 {
+			chirp["publish_at"] = time.Now().Add(publishIn)
+		}
+		body, err := json.Marshal(chirp)
+		if err != nil {
+			t.Fatalf("marshalling the chirp: %s", err)
+		}
+
+		r := httptest.NewRequest(http.MethodPost, "/api/chirps", strings.NewReader(string(body)))
+		r.SetPathValue("chirpID", strconv.Itoa(chirpID))
+		r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserID: plans[plan]}))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	chirps := map[string]int{}
+	for plan, userID := range plans {
+		chirp, err := db.CreateChirp("first", userID)
+		if err != nil {
+			t.Fatalf("CreateChirp: %s", err)
+		}
+		chirps[plan] = chirp.ID
+	}
+
+	horizon := planEntitlements[database.PlanChirpyRed].ScheduleHorizon
+	tests := []struct {
+		name      string
+		plan      string
+		edit      bool
+		length    int
+		publishIn time.Duration
+		want      int
+	}{
+		{name: "longest free chirp", plan: planFree, length: 140, want: http.StatusCreated},
+		{name: "too long for free", plan: planFree, length: 141, want: http.StatusBadRequest},
+		{name: "longest Chirpy Red chirp", plan: database.PlanChirpyRed, length: 1000, want: http.StatusCreated},
+		{name: "too long for Chirpy Red", plan: database.PlanChirpyRed, length: 1001, want: http.StatusBadRequest},
+
+		{name: "edit on free", plan: planFree, edit: true, length: 10, want: http.StatusForbidden},
+		{name: "edit on Chirpy Red", plan: database.PlanChirpyRed, edit: true, length: 10, want: http.StatusOK},
+		{name: "edit too long for Chirpy Red", plan: database.PlanChirpyRed, edit: true, length: 1001, want: http.StatusBadRequest},
+
+		{name: "schedule on free", plan: planFree, length: 10, publishIn: time.Hour, want: http.StatusForbidden},
+		{name: "schedule on Chirpy Red", plan: database.PlanChirpyRed, length: 10, publishIn: time.Hour, want: http.StatusAccepted},
+		{name: "schedule past the horizon", plan: database.PlanChirpyRed, length: 10, publishIn: horizon + time.Hour, want: http.StatusBadRequest},
+		{name: "schedule in the past", plan: database.PlanChirpyRed, length: 10, publishIn: -time.Hour, want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		handler := cfg.createChirp
+		if tt.edit {
+			handler = cfg.editChirp
+		}
+		if got := post(tt.plan, handler, chirps[tt.plan], tt.length, tt.publishIn); got != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	// every plan gets its own number of chirps an hour, scheduled ones
+	// included. The free user posted 1 above, the Chirpy Red one 2.
+	free := planEntitlements[planFree].ChirpsPerHour
+	for i := 1; i < free; i++ {
+		if got := post(planFree, cfg.createChirp, 0, 10, 0); got != http.StatusCreated {
+			t.Fatalf("free chirp %d: status = %d, want %d", i+1, got, http.StatusCreated)
+		}
+	}
+	if got := post(planFree, cfg.createChirp, 0, 10, 0); got != http.StatusTooManyRequests {
+		t.Errorf("free chirp past the limit: status = %d, want %d", got, http.StatusTooManyRequests)
+	}
+	for i := 2; i <= free; i++ {
+		if got := post(database.PlanChirpyRed, cfg.createChirp, 0, 10, 0); got != http.StatusCreated {
+			t.Fatalf("Chirpy Red chirp %d: status = %d, want %d", i+1, got, http.StatusCreated)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Purposes of action tokens. Each one is a JWT audience, so a token
+// issued for one is never accepted for another or as an access token.
+const (
+	PurposeTwoFactor     = "chirpy-2fa"
+	PurposeVerifyEmail   = "chirpy-verify-email"
+	PurposePasswordReset = "chirpy-password-reset"
+)
+
+// How long action tokens stay valid
+const (
+	// ChallengeExpiration is how long a user has to enter their
+	// second factor after the password was accepted
+	ChallengeExpiration     = 5 * time.Minute
+	VerifyEmailExpiration   = 24 * time.Hour
+	PasswordResetExpiration = time.Hour
+)
+
+var ErrStaleActionToken = errors.New("token was already used")
+
+type actionClaims struct {
+	jwt.RegisteredClaims
+	// State is a digest of what the token acts on, like the email to
+	// verify or the password hash to replace. Once that changes the
+	// token stops matching, so it's single use without storing it.
+	State string `json:"st,omitempty"`
+}
+
+// IssueActionToken returns a signed token letting userID do purpose
+// for ttl, as long as state doesn't change
+func IssueActionToken(userID int, purpose, state string, ttl time.Duration, keys *KeySet) (string, error) {
+	now := time.Now().UTC()
+
+	return keys.sign(actionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			Audience:  jwt.ClaimStrings{purpose},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			Subject:   strconv.Itoa(userID),
+		},
+		State: stateDigest(state),
+	})
+}
+
+// ValidateActionToken returns the user a token for purpose was issued
+// to. currentState looks up the state of that user now, which must be
+// what it was when the token was issued; it may be nil for tokens
+// issued with an empty state.
+func ValidateActionToken(tokenStr, purpose string, keys *KeySet, currentState func(userID int) (string, error)) (int, error) {
+	claims := &actionClaims{}
+	_, err := jwt.ParseWithClaims(tokenStr, claims, keys.keyFunc,
+		jwt.WithIssuer("chirpy"),
+		jwt.WithAudience(purpose),
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return 0, err
+	}
+
+	state := ""
+	if currentState != nil {
+		state, err = currentState(userID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(claims.State), []byte(stateDigest(state))) != 1 {
+		return 0, ErrStaleActionToken
+	}
+
+	return userID, nil
+}
+
+func stateDigest(state string) string {
+	if state == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:16])
+}
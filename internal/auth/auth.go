@@ -4,11 +4,12 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const JwtExpirationSeconds = 360
@@ -18,16 +19,13 @@ type RefreshToken struct {
 	Token        string
 }
 
-func ValidateToken(password, reqPassword []byte) error {
-	err := bcrypt.CompareHashAndPassword(password, reqPassword)
-	if err != nil {
-		return err
-	}
-	return nil
+// Claims are the claims of a Chirpy access token
+type Claims struct {
+	jwt.RegisteredClaims
+	Roles []string `json:"roles,omitempty"`
 }
 
-func IssueJWT(userID int, jwtSecret string) (string, error) {
-	var token string
+func IssueJWT(userID int, roles []string, keys *KeySet) (string, error) {
 	now := time.Now().UTC()
 	// Create a NumericDate from the current time
 	numericNow := jwt.NewNumericDate(now)
@@ -35,18 +33,15 @@ func IssueJWT(userID int, jwtSecret string) (string, error) {
 	expirationDate := now.Add(time.Duration(JwtExpirationSeconds) * time.Second)
 	numericExp := jwt.NewNumericDate(expirationDate)
 
-	jwt := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  numericNow,
-		ExpiresAt: numericExp,
-		Subject:   strconv.Itoa(userID),
+	return keys.sign(Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			IssuedAt:  numericNow,
+			ExpiresAt: numericExp,
+			Subject:   strconv.Itoa(userID),
+		},
+		Roles: roles,
 	})
-
-	token, err := jwt.SignedString([]byte(jwtSecret))
-	if err != nil {
-		return token, err
-	}
-	return token, nil
 }
 
 func GenerateRefreshToken() (RefreshToken, error) {
@@ -66,17 +61,45 @@ func GenerateRefreshToken() (RefreshToken, error) {
 	return token, nil
 }
 
-func GenerateHashedPass(password string) ([]byte, error) {
-	pass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	return pass, err
+// AccessTokenPrefix starts every personal access token, which tells
+// them apart from JWTs and makes them easy to spot in leaked code
+const AccessTokenPrefix = "chirpy_pat_"
+
+// Scopes a personal access token can be limited to
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	// ScopeAccountRead and ScopeAccountWrite cover the caller's own
+	// account: profile, email, 2FA, sessions and access tokens
+	ScopeAccountRead  = "account:read"
+	ScopeAccountWrite = "account:write"
+	// ScopeAdmin lets a token act with its owner's moderator
+	// and admin roles
+	ScopeAdmin = "admin"
+)
+
+// GenerateAccessToken returns a new random personal access token
+func GenerateAccessToken() (string, error) {
+	randB := make([]byte, 32)
+	_, err := rand.Read(randB)
+	if err != nil {
+		return "", err
+	}
+
+	return AccessTokenPrefix + hex.EncodeToString(randB), nil
 }
 
-func ValidateJWTToken(tokenStr, jwtSecret string) (*jwt.Token, error) {
-	token, err := jwt.ParseWithClaims(tokenStr, &jwt.RegisteredClaims{
-		Issuer: "chirpy",
-	}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(jwtSecret), nil
-	})
+// IsAccessToken reports whether a bearer token is a personal access token
+func IsAccessToken(token string) bool {
+	return strings.HasPrefix(token, AccessTokenPrefix)
+}
+
+// ValidateJWTToken verifies the token with the key named by its kid header
+func ValidateJWTToken(tokenStr string, keys *KeySet) (*jwt.Token, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, keys.keyFunc,
+		jwt.WithIssuer("chirpy"),
+		jwt.WithValidMethods([]string{"HS256", "RS256", "EdDSA"}),
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -85,5 +108,37 @@ func ValidateJWTToken(tokenStr, jwtSecret string) (*jwt.Token, error) {
 		return nil, errors.New("invalid token")
 	}
 
+	// access tokens have no audience, anything with one is an action
+	// token meant for something else, like a second factor challenge
+	if claims, ok := token.Claims.(*Claims); ok && len(claims.Audience) > 0 {
+		return nil, errors.New("not an access token")
+	}
+
 	return token, nil
 }
+
+var ErrNoAuthHeader = errors.New("no authorization header included in request")
+
+// GetBearerToken extracts the token from an "Authorization: Bearer <token>" header
+func GetBearerToken(headers http.Header) (string, error) {
+	return getAuthorization(headers, "Bearer")
+}
+
+// GetAPIKey extracts the key from an "Authorization: ApiKey <key>" header
+func GetAPIKey(headers http.Header) (string, error) {
+	return getAuthorization(headers, "ApiKey")
+}
+
+func getAuthorization(headers http.Header, scheme string) (string, error) {
+	authHeader := headers.Get("Authorization")
+	if authHeader == "" {
+		return "", ErrNoAuthHeader
+	}
+
+	fields := strings.Fields(authHeader)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], scheme) {
+		return "", errors.New("malformed authorization header")
+	}
+
+	return fields[1], nil
+}
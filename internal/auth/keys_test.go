@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testKeys are the keys written by writeTestKeys
+type testKeys struct {
+	ed25519 ed25519.PrivateKey
+	rsa     *rsa.PrivateKey
+	// retired only has its public key in the set
+	retired ed25519.PrivateKey
+}
+
+// writeTestKeys writes an Ed25519 and an RSA private key and the public
+// half of a retired Ed25519 key to a new directory
+func writeTestKeys(t *testing.T) (string, testKeys) {
+	t.Helper()
+
+	var keys testKeys
+	var err error
+	_, keys.ed25519, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keys.retired, err = ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	writePEM := func(name, blockType string, der []byte) {
+		t.Helper()
+		data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+		err := os.WriteFile(filepath.Join(dir, name+".pem"), data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(keys.ed25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM("2024-01", "PRIVATE KEY", der)
+	writePEM("2024-06", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(keys.rsa))
+	der, err = x509.MarshalPKIXPublicKey(keys.retired.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM("2023-06", "PUBLIC KEY", der)
+
+	return dir, keys
+}
+
+func TestLoadKeySet(t *testing.T) {
+	dir, _ := writeTestKeys(t)
+
+	tests := []struct {
+		signingKID string
+		wantKID    string
+		wantAlg    string
+		wantErr    bool
+	}{
+		// the last private key by name
+		{signingKID: "", wantKID: "2024-06", wantAlg: "RS256"},
+		{signingKID: "2024-01", wantKID: "2024-01", wantAlg: "EdDSA"},
+		{signingKID: "2023-06", wantErr: true},
+		{signingKID: "missing", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ks, err := LoadKeySet(dir, tt.signingKID)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LoadKeySet(%q): err = %v, want error %t", tt.signingKID, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if ks.signing.ID != tt.wantKID || ks.signing.Method.Alg() != tt.wantAlg {
+			t.Errorf("LoadKeySet(%q) signs with %s %s, want %s %s",
+				tt.signingKID, ks.signing.ID, ks.signing.Method.Alg(), tt.wantKID, tt.wantAlg)
+		}
+	}
+
+	_, err := LoadKeySet(t.TempDir(), "")
+	if err == nil {
+		t.Error("LoadKeySet of an empty directory succeeded")
+	}
+}
+
+func TestValidateJWTToken(t *testing.T) {
+	dir, keys := writeTestKeys(t)
+	ks, err := LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatalf("LoadKeySet: %s", err)
+	}
+
+	now := time.Now()
+	claims := func() Claims {
+		return Claims{RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    "chirpy",
+			Subject:   "1",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		}}
+	}
+	sign := func(method jwt.SigningMethod, kid string, c Claims, key any) string {
+		t.Helper()
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	current, err := IssueJWT(1, []string{"user"}, ks)
+	if err != nil {
+		t.Fatalf("IssueJWT: %s", err)
+	}
+	expired := claims()
+	expired.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+	otherIssuer := claims()
+	otherIssuer.Issuer = "someone"
+	withAudience := claims()
+	withAudience.Audience = jwt.ClaimStrings{"2fa"}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&keys.rsa.PublicKey)})
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "signed with the current key", token: current},
+		{name: "signed with another key of the set", token: sign(jwt.SigningMethodEdDSA, "2024-01", claims(), keys.ed25519)},
+		{name: "signed with a retired key", token: sign(jwt.SigningMethodEdDSA, "2023-06", claims(), keys.retired)},
+		{name: "unknown kid", token: sign(jwt.SigningMethodEdDSA, "2025-01", claims(), keys.ed25519), wantErr: true},
+		{name: "no kid", token: sign(jwt.SigningMethodEdDSA, "", claims(), keys.ed25519), wantErr: true},
+		{name: "kid of another key", token: sign(jwt.SigningMethodEdDSA, "2023-06", claims(), keys.ed25519), wantErr: true},
+		{name: "alg that isn't the key's", token: sign(jwt.SigningMethodRS512, "2024-06", claims(), keys.rsa), wantErr: true},
+		{name: "public key as an HMAC secret", token: sign(jwt.SigningMethodHS256, "2024-06", claims(), publicPEM), wantErr: true},
+		{name: "expired", token: sign(jwt.SigningMethodRS256, "2024-06", expired, keys.rsa), wantErr: true},
+		{name: "other issuer", token: sign(jwt.SigningMethodRS256, "2024-06", otherIssuer, keys.rsa), wantErr: true},
+		{name: "action token", token: sign(jwt.SigningMethodRS256, "2024-06", withAudience, keys.rsa), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateJWTToken(tt.token, ks)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateJWTToken: err = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHMACKeySet(t *testing.T) {
+	ks := NewHMACKeySet("secret")
+
+	token, err := IssueJWT(7, nil, ks)
+	if err != nil {
+		t.Fatalf("IssueJWT: %s", err)
+	}
+	parsed, err := ValidateJWTToken(token, ks)
+	if err != nil {
+		t.Fatalf("ValidateJWTToken: %s", err)
+	}
+	if sub, _ := parsed.Claims.GetSubject(); sub != strconv.Itoa(7) {
+		t.Errorf("subject = %q, want 7", sub)
+	}
+
+	_, err = ValidateJWTToken(token, NewHMACKeySet("other secret"))
+	if err == nil {
+		t.Error("token validated with another secret")
+	}
+
+	if jwks := ks.JWKS(); len(jwks.Keys) != 0 {
+		t.Errorf("JWKS published the shared secret: %+v", jwks.Keys)
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	dir, keys := writeTestKeys(t)
+	ks, err := LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatalf("LoadKeySet: %s", err)
+	}
+
+	jwks := ks.JWKS()
+	if len(jwks.Keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(jwks.Keys))
+	}
+
+	tests := []struct {
+		kid  string
+		kty  string
+		alg  string
+		crv  string
+		x    []byte
+		n, e []byte
+	}{
+		{kid: "2023-06", kty: "OKP", alg: "EdDSA", crv: "Ed25519", x: keys.retired.Public().(ed25519.PublicKey)},
+		{kid: "2024-01", kty: "OKP", alg: "EdDSA", crv: "Ed25519", x: keys.ed25519.Public().(ed25519.PublicKey)},
+		{kid: "2024-06", kty: "RSA", alg: "RS256", n: keys.rsa.N.Bytes(), e: big.NewInt(int64(keys.rsa.E)).Bytes()},
+	}
+
+	encode := base64.RawURLEncoding.EncodeToString
+	for i, tt := range tests {
+		jwk := jwks.Keys[i]
+		if jwk.Kid != tt.kid || jwk.Kty != tt.kty || jwk.Alg != tt.alg || jwk.Crv != tt.crv || jwk.Use != "sig" {
+			t.Errorf("key %d = %+v, want kid %s kty %s alg %s crv %q", i, jwk, tt.kid, tt.kty, tt.alg, tt.crv)
+		}
+		if tt.x != nil && jwk.X != encode(tt.x) {
+			t.Errorf("key %s: x = %s, want %s", tt.kid, jwk.X, encode(tt.x))
+		}
+		if tt.n != nil && (jwk.N != encode(tt.n) || jwk.E != encode(tt.e)) {
+			t.Errorf("key %s: n, e = %s, %s, want %s, %s", tt.kid, jwk.N, jwk.E, encode(tt.n), encode(tt.e))
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+)
+
+// bcryptMaxLength is the number of bytes past which bcrypt
+// ignores the rest of a password
+const bcryptMaxLength = 72
+
+const argon2SaltLength = 16
+
+const DefaultBcryptCost = bcrypt.DefaultCost
+
+var ErrPasswordMismatch = errors.New("password doesn't match")
+
+// Argon2Params are the argon2id cost parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params is the second recommended option of RFC 9106
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	KeyLength:   32,
+}
+
+// PasswordHasher hashes new passwords with one algorithm and verifies
+// hashes of any supported one. Hashes are self-describing: argon2id ones
+// use the PHC string format and bcrypt ones the usual $2a$ format, both
+// carry their algorithm version and parameters.
+type PasswordHasher struct {
+	algorithm  string
+	bcryptCost int
+	argon2     Argon2Params
+	// dummyHash is a hash no password is checked against for real
+	dummyHash string
+}
+
+// NewPasswordHasher returns a hasher hashing with algorithm,
+// using bcryptCost or argon2 as its parameters
+func NewPasswordHasher(algorithm string, bcryptCost int, argon2 Argon2Params) (*PasswordHasher, error) {
+	h := &PasswordHasher{
+		algorithm:  algorithm,
+		bcryptCost: bcryptCost,
+		argon2:     argon2,
+	}
+
+	switch algorithm {
+	case HashArgon2id:
+		if argon2.Memory < 8*uint32(argon2.Parallelism) || argon2.Iterations < 1 || argon2.Parallelism < 1 || argon2.KeyLength < 16 {
+			return nil, fmt.Errorf("invalid argon2id parameters %+v", argon2)
+		}
+	case HashBcrypt:
+		if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost %d out of range [%d, %d]", bcryptCost, bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return nil, fmt.Errorf("unknown password hash algorithm %q", algorithm)
+	}
+
+	dummyHash, err := h.Hash("chirpy dummy password")
+	if err != nil {
+		return nil, err
+	}
+	h.dummyHash = dummyHash
+
+	return h, nil
+}
+
+// MaxLength is the longest password the algorithm can hash
+// without ignoring part of it, 0 when there is no such limit
+func (h *PasswordHasher) MaxLength() int {
+	if h.algorithm == HashBcrypt {
+		return bcryptMaxLength
+	}
+	return 0
+}
+
+// Hash hashes password with the configured algorithm and parameters
+func (h *PasswordHasher) Hash(password string) (string, error) {
+	if h.algorithm == HashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	p := h.argon2
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// Verify checks password against hash, returning ErrPasswordMismatch
+// when it's wrong. needsRehash reports whether a matching hash was made
+// with another algorithm or parameters than the configured ones, and
+// should be replaced with a new Hash of password.
+func (h *PasswordHasher) Verify(hash, password string) (needsRehash bool, err error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		p, salt, key, err := parseArgon2id(hash)
+		if err != nil {
+			return false, err
+		}
+
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+		if subtle.ConstantTimeCompare(key, other) != 1 {
+			return false, ErrPasswordMismatch
+		}
+		return h.algorithm != HashArgon2id || p != h.argon2, nil
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) || errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return false, ErrPasswordMismatch
+	}
+	if err != nil {
+		return false, err
+	}
+
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return false, err
+	}
+	return h.algorithm != HashBcrypt || cost != h.bcryptCost, nil
+}
+
+// VerifyDummy takes as long as Verify does with the configured
+// algorithm, so that logins with an unknown email can't be told apart
+// from wrong passwords by their timing
+func (h *PasswordHasher) VerifyDummy(password string) {
+	h.Verify(h.dummyHash, password)
+}
+
+// parseArgon2id parses a hash in the PHC string format,
+// $argon2id$v=19$m=65536,t=3,p=4$salt$key
+func parseArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return p, nil, nil, errors.New("malformed argon2id hash")
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash version: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash parameters: %w", err)
+	}
+	if p.Iterations < 1 || p.Parallelism < 1 {
+		return p, nil, nil, errors.New("invalid argon2id hash parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash salt: %w", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("malformed argon2id hash key: %w", err)
+	}
+	p.KeyLength = uint32(len(key))
+
+	return p, salt, key, nil
+}
+
+// PasswordPolicy decides which passwords users may choose
+type PasswordPolicy struct {
+	// MinLength is in characters
+	MinLength int
+	// MaxLength is in bytes, what hashing cares about, 0 for no limit
+	MaxLength int
+	// breached are known leaked passwords
+	breached map[string]struct{}
+}
+
+// NewPasswordPolicy returns a policy rejecting the passwords
+// listed one per line in breachedFile, if one is given
+func NewPasswordPolicy(minLength, maxLength int, breachedFile string) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		MinLength: minLength,
+		MaxLength: maxLength,
+		breached:  make(map[string]struct{}),
+	}
+	if breachedFile == "" {
+		return policy, nil
+	}
+
+	f, err := os.Open(breachedFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		password := strings.TrimSuffix(scanner.Text(), "\r")
+		if password != "" {
+			policy.breached[password] = struct{}{}
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", breachedFile, err)
+	}
+
+	return policy, nil
+}
+
+// Check returns why password isn't allowed, or nil if it is
+func (p *PasswordPolicy) Check(password string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.MinLength)
+	}
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		return fmt.Errorf("password must be at most %d bytes long", p.MaxLength)
+	}
+	if _, ok := p.breached[password]; ok {
+		return errors.New("password appeared in a data breach, choose another one")
+	}
+	return nil
+}
@@ -0,0 +1,233 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2Params are cheap enough to hash with in every test
+var testArgon2Params = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, KeyLength: 32}
+
+func newTestHasher(t *testing.T, algorithm string, bcryptCost int, argon2 Argon2Params) *PasswordHasher {
+	t.Helper()
+
+	h, err := NewPasswordHasher(algorithm, bcryptCost, argon2)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher(%s): %s", algorithm, err)
+	}
+	return h
+}
+
+func TestHashAndVerify(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		prefix    string
+	}{
+		{algorithm: HashArgon2id, prefix: "$argon2id$v=19$m=64,t=1,p=1$"},
+		{algorithm: HashBcrypt, prefix: "$2a$04$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			h := newTestHasher(t, tt.algorithm, bcrypt.MinCost, testArgon2Params)
+
+			hash, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Hash: %s", err)
+			}
+			if !strings.HasPrefix(hash, tt.prefix) {
+				t.Errorf("hash %q doesn't start with %q", hash, tt.prefix)
+			}
+
+			other, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatalf("Hash: %s", err)
+			}
+			if other == hash {
+				t.Error("two hashes of a password are the same, the salt isn't random")
+			}
+
+			needsRehash, err := h.Verify(hash, "correct horse")
+			if err != nil {
+				t.Fatalf("Verify of the right password: %s", err)
+			}
+			if needsRehash {
+				t.Error("a hash made with the configured parameters needs a rehash")
+			}
+
+			_, err = h.Verify(hash, "correct horsf")
+			if !errors.Is(err, ErrPasswordMismatch) {
+				t.Errorf("Verify of a wrong password: err = %v, want ErrPasswordMismatch", err)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	argon2id := newTestHasher(t, HashArgon2id, bcrypt.MinCost, testArgon2Params)
+	argon2Hash, err := argon2id.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	bcryptHash, err := newTestHasher(t, HashBcrypt, bcrypt.MinCost, testArgon2Params).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+
+	changed := func(change func(p *Argon2Params)) Argon2Params {
+		p := testArgon2Params
+		change(&p)
+		return p
+	}
+
+	tests := []struct {
+		name       string
+		hasher     *PasswordHasher
+		hash       string
+		wantRehash bool
+	}{
+		{name: "same argon2id parameters", hasher: argon2id, hash: argon2Hash},
+		{name: "argon2id memory changed", hasher: newTestHasher(t, HashArgon2id, bcrypt.MinCost, changed(func(p *Argon2Params) { p.Memory = 128 })), hash: argon2Hash, wantRehash: true},
+		{name: "argon2id iterations changed", hasher: newTestHasher(t, HashArgon2id, bcrypt.MinCost, changed(func(p *Argon2Params) { p.Iterations = 2 })), hash: argon2Hash, wantRehash: true},
+		{name: "argon2id parallelism changed", hasher: newTestHasher(t, HashArgon2id, bcrypt.MinCost, changed(func(p *Argon2Params) { p.Parallelism = 2 })), hash: argon2Hash, wantRehash: true},
+		{name: "argon2id key length changed", hasher: newTestHasher(t, HashArgon2id, bcrypt.MinCost, changed(func(p *Argon2Params) { p.KeyLength = 16 })), hash: argon2Hash, wantRehash: true},
+		{name: "argon2id hash with bcrypt configured", hasher: newTestHasher(t, HashBcrypt, bcrypt.MinCost, testArgon2Params), hash: argon2Hash, wantRehash: true},
+		{name: "same bcrypt cost", hasher: newTestHasher(t, HashBcrypt, bcrypt.MinCost, testArgon2Params), hash: bcryptHash},
+		{name: "bcrypt cost changed", hasher: newTestHasher(t, HashBcrypt, bcrypt.MinCost+1, testArgon2Params), hash: bcryptHash, wantRehash: true},
+		{name: "bcrypt hash with argon2id configured", hasher: argon2id, hash: bcryptHash, wantRehash: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			needsRehash, err := tt.hasher.Verify(tt.hash, "correct horse")
+			if err != nil {
+				t.Fatalf("Verify: %s", err)
+			}
+			if needsRehash != tt.wantRehash {
+				t.Errorf("needsRehash = %t, want %t", needsRehash, tt.wantRehash)
+			}
+
+			// a wrong password is never worth rehashing
+			needsRehash, err = tt.hasher.Verify(tt.hash, "wrong")
+			if !errors.Is(err, ErrPasswordMismatch) || needsRehash {
+				t.Errorf("Verify of a wrong password = %t, %v, want false, ErrPasswordMismatch", needsRehash, err)
+			}
+		})
+	}
+}
+
+func TestParseArgon2id(t *testing.T) {
+	// salt "saltsaltsaltsalt" and a 4 byte key
+	const salt, key = "c2FsdHNhbHRzYWx0c2FsdA", "a2V5cw"
+
+	tests := []struct {
+		name    string
+		hash    string
+		want    Argon2Params
+		wantErr bool
+	}{
+		{name: "valid", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$" + key, want: Argon2Params{Memory: 65536, Iterations: 3, Parallelism: 4, KeyLength: 4}},
+		{name: "missing key", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt, wantErr: true},
+		{name: "older version", hash: "$argon2id$v=16$m=65536,t=3,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "no version", hash: "$argon2id$m=65536,t=3,p=4$" + salt + "$" + key + "$", wantErr: true},
+		{name: "parameters out of order", hash: "$argon2id$v=19$t=3,m=65536,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "no iterations", hash: "$argon2id$v=19$m=65536,t=0,p=4$" + salt + "$" + key, wantErr: true},
+		{name: "no parallelism", hash: "$argon2id$v=19$m=65536,t=3,p=0$" + salt + "$" + key, wantErr: true},
+		{name: "parallelism overflows", hash: "$argon2id$v=19$m=65536,t=3,p=256$" + salt + "$" + key, wantErr: true},
+		{name: "salt isn't base64", hash: "$argon2id$v=19$m=65536,t=3,p=4$salt!$" + key, wantErr: true},
+		{name: "key isn't base64", hash: "$argon2id$v=19$m=65536,t=3,p=4$" + salt + "$key!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, gotSalt, gotKey, err := parseArgon2id(tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p != tt.want {
+				t.Errorf("params = %+v, want %+v", p, tt.want)
+			}
+			if string(gotSalt) != "saltsaltsaltsalt" || string(gotKey) != "keys" {
+				t.Errorf("salt, key = %q, %q", gotSalt, gotKey)
+			}
+		})
+	}
+
+	// a hash that doesn't parse is an error, not a mismatch
+	h := newTestHasher(t, HashArgon2id, bcrypt.MinCost, testArgon2Params)
+	_, err := h.Verify("$argon2id$v=16$m=64,t=1,p=1$"+salt+"$"+key, "keys")
+	if err == nil || errors.Is(err, ErrPasswordMismatch) {
+		t.Errorf("Verify of an unsupported hash: err = %v", err)
+	}
+}
+
+func TestNewPasswordHasherRejectsBadParameters(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		cost      int
+		argon2    Argon2Params
+	}{
+		{name: "unknown algorithm", algorithm: "md5", cost: bcrypt.MinCost, argon2: testArgon2Params},
+		{name: "bcrypt cost too low", algorithm: HashBcrypt, cost: bcrypt.MinCost - 1, argon2: testArgon2Params},
+		{name: "bcrypt cost too high", algorithm: HashBcrypt, cost: bcrypt.MaxCost + 1, argon2: testArgon2Params},
+		{name: "argon2id memory under 8 KiB per lane", algorithm: HashArgon2id, argon2: Argon2Params{Memory: 15, Iterations: 1, Parallelism: 2, KeyLength: 32}},
+		{name: "argon2id no iterations", algorithm: HashArgon2id, argon2: Argon2Params{Memory: 64, Parallelism: 1, KeyLength: 32}},
+		{name: "argon2id short key", algorithm: HashArgon2id, argon2: Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, KeyLength: 8}},
+	}
+
+	for _, tt := range tests {
+		_, err := NewPasswordHasher(tt.algorithm, tt.cost, tt.argon2)
+		if err == nil {
+			t.Errorf("%s: NewPasswordHasher succeeded", tt.name)
+		}
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	breached := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(breached, []byte("password123\r\nletmein!!\n\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := NewPasswordPolicy(8, 12, breached)
+	if err != nil {
+		t.Fatalf("NewPasswordPolicy: %s", err)
+	}
+
+	tests := []struct {
+		password string
+		wantErr  bool
+	}{
+		{password: "correct1", wantErr: false},
+		{password: "short", wantErr: true},
+		// the minimum is in characters and the maximum in bytes
+		{password: "éé123456", wantErr: false},
+		{password: "éééé12", wantErr: true},
+		{password: "éééééé12", wantErr: true},
+		{password: "thirteen char", wantErr: true},
+		{password: "password123", wantErr: true},
+		{password: "letmein!!", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		err := policy.Check(tt.password)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Check(%q): err = %v, want error %t", tt.password, err, tt.wantErr)
+		}
+	}
+
+	_, err = NewPasswordPolicy(8, 12, filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("NewPasswordPolicy with a missing breached file succeeded")
+	}
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"errors"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the key of the RFC 4226 and RFC 6238 SHA-1 test vectors,
+// "12345678901234567890", in base32
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+
+	key := []byte("12345678901234567890")
+	for counter, code := range want {
+		if got := hotp(key, int64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, cut to the last 6 of their 8 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+
+	for _, tt := range tests {
+		step, err := ValidateTOTP(rfcSecret, tt.code, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Errorf("ValidateTOTP(%s at %d): %s", tt.code, tt.unix, err)
+			continue
+		}
+		if step != tt.unix/totpPeriod {
+			t.Errorf("ValidateTOTP(%s at %d) = step %d, want %d", tt.code, tt.unix, step, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	// "287082" is the code of step 1, 30s to 59s
+	tests := []struct {
+		name    string
+		secret  string
+		code    string
+		unix    int64
+		wantErr error
+	}{
+		{name: "current step", secret: rfcSecret, code: "287082", unix: 45},
+		{name: "previous step", secret: rfcSecret, code: "287082", unix: 75},
+		{name: "next step", secret: rfcSecret, code: "287082", unix: 15},
+		{name: "two steps late", secret: rfcSecret, code: "287082", unix: 95, wantErr: ErrInvalidTOTP},
+		{name: "wrong code", secret: rfcSecret, code: "287083", unix: 45, wantErr: ErrInvalidTOTP},
+		{name: "empty code", secret: rfcSecret, code: "", unix: 45, wantErr: ErrInvalidTOTP},
+		{name: "surrounding spaces", secret: rfcSecret, code: " 287082 ", unix: 45},
+		{name: "lowercase secret", secret: "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", code: "287082", unix: 45},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := ValidateTOTP(tt.secret, tt.code, time.Unix(tt.unix, 0))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && step != 1 {
+				t.Errorf("step = %d, want 1", step)
+			}
+		})
+	}
+
+	_, err := ValidateTOTP("not base32!", "287082", time.Unix(45, 0))
+	if err == nil {
+		t.Error("ValidateTOTP accepted a secret that isn't base32")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %s", err)
+	}
+
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		t.Fatalf("secret %q isn't base32: %s", secret, err)
+	}
+	if len(key) != 20 {
+		t.Errorf("secret is %d bytes, want 20", len(key))
+	}
+
+	uri, err := url.Parse(TOTPURI(secret, "a@b.com", "Chirpy"))
+	if err != nil {
+		t.Fatalf("TOTPURI isn't a URL: %s", err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Query().Get("secret") != secret {
+		t.Errorf("TOTPURI = %s", uri)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	if err != nil {
+		t.Fatalf("GenerateRecoveryCodes: %s", err)
+	}
+	if len(codes) != 10 {
+		t.Fatalf("got %d codes, want 10", len(codes))
+	}
+
+	format := regexp.MustCompile(`^[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}$`)
+	hashes := make(map[string]bool)
+	for _, code := range codes {
+		if !format.MatchString(code) {
+			t.Errorf("code %q isn't formatted like 1a2b-3c4d-5e6f-7a8b", code)
+		}
+		hashes[HashRecoveryCode(code)] = true
+	}
+	if len(hashes) != len(codes) {
+		t.Errorf("%d codes hash to %d distinct hashes", len(codes), len(hashes))
+	}
+}
+
+func TestHashRecoveryCode(t *testing.T) {
+	want := HashRecoveryCode("1a2b-3c4d-5e6f-7a8b")
+
+	tests := []struct {
+		typed string
+		same  bool
+	}{
+		{typed: "1a2b-3c4d-5e6f-7a8b", same: true},
+		{typed: "1A2B-3C4D-5E6F-7A8B", same: true},
+		{typed: "1a2b3c4d5e6f7a8b", same: true},
+		{typed: "  1a2b-3c4d-5e6f-7a8b\n", same: true},
+		{typed: "1a2b-3c4d-5e6f-7a8c", same: false},
+		{typed: "", same: false},
+	}
+
+	for _, tt := range tests {
+		if got := HashRecoveryCode(tt.typed) == want; got != tt.same {
+			t.Errorf("HashRecoveryCode(%q) matches: %t, want %t", tt.typed, got, tt.same)
+		}
+	}
+	if want == "1a2b-3c4d-5e6f-7a8b" || len(want) != 64 {
+		t.Errorf("HashRecoveryCode = %q, want a SHA-256 hex digest", want)
+	}
+}
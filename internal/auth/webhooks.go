@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webhookSignaturePrefix names the algorithm of a webhook signature
+const webhookSignaturePrefix = "sha256="
+
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleSignature   = errors.New("webhook timestamp outside the tolerance window")
+)
+
+// SignWebhook returns the signature of a webhook body sent at
+// timestamp, in unix seconds: the HMAC-SHA256 with secret of
+// the timestamp, a dot and the raw body
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	return webhookSignaturePrefix + hex.EncodeToString(webhookMAC(secret, strconv.FormatInt(timestamp, 10), body))
+}
+
+// VerifyWebhook checks the signature of a webhook body sent at
+// timestamp, rejecting timestamps further than tolerance from now
+// so that a captured delivery can't be replayed later
+func VerifyWebhook(secret, timestamp, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	sent := time.Unix(ts, 0)
+	if sent.Before(now.Add(-tolerance)) || sent.After(now.Add(tolerance)) {
+		return ErrStaleSignature
+	}
+
+	if !strings.HasPrefix(signature, webhookSignaturePrefix) {
+		return ErrInvalidSignature
+	}
+	mac, err := hex.DecodeString(strings.TrimPrefix(signature, webhookSignaturePrefix))
+	if err != nil {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal(mac, webhookMAC(secret, timestamp, body)) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func webhookMAC(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
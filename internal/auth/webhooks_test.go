@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhook(t *testing.T) {
+	const secret = "whsec"
+	body := []byte(`{"event":"user.upgraded","data":{"user_id":1}}`)
+
+	now := time.Unix(1700000000, 0)
+	sentAt := now.Add(-time.Minute).Unix()
+	ts := strconv.FormatInt(sentAt, 10)
+	signature := SignWebhook(secret, sentAt, body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		wantErr   error
+	}{
+		{name: "valid", secret: secret, timestamp: ts, signature: signature, body: body},
+		{name: "tampered body", secret: secret, timestamp: ts, signature: signature, body: []byte(`{"event":"user.upgraded","data":{"user_id":2}}`), wantErr: ErrInvalidSignature},
+		{name: "empty body", secret: secret, timestamp: ts, signature: signature, body: nil, wantErr: ErrInvalidSignature},
+		{name: "tampered signature", secret: secret, timestamp: ts, signature: signature[:len(signature)-1] + flipHex(signature[len(signature)-1]), body: body, wantErr: ErrInvalidSignature},
+		{name: "truncated signature", secret: secret, timestamp: ts, signature: signature[:len(signature)-2], body: body, wantErr: ErrInvalidSignature},
+		{name: "signature without prefix", secret: secret, timestamp: ts, signature: strings.TrimPrefix(signature, webhookSignaturePrefix), body: body, wantErr: ErrInvalidSignature},
+		{name: "signature isn't hex", secret: secret, timestamp: ts, signature: webhookSignaturePrefix + "zz", body: body, wantErr: ErrInvalidSignature},
+		{name: "no signature", secret: secret, timestamp: ts, signature: "", body: body, wantErr: ErrInvalidSignature},
+		{name: "other secret", secret: "other", timestamp: ts, signature: signature, body: body, wantErr: ErrInvalidSignature},
+		// the timestamp is signed too, it can't be moved into the window
+		{name: "timestamp changed", secret: secret, timestamp: strconv.FormatInt(sentAt+1, 10), signature: signature, body: body, wantErr: ErrInvalidSignature},
+		{name: "no timestamp", secret: secret, timestamp: "", signature: signature, body: body, wantErr: ErrInvalidSignature},
+		{name: "timestamp isn't a number", secret: secret, timestamp: "yesterday", signature: signature, body: body, wantErr: ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyWebhook(tt.secret, tt.timestamp, tt.signature, tt.body, now, 5*time.Minute)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookTimestampWindow(t *testing.T) {
+	const secret = "whsec"
+	const tolerance = 5 * time.Minute
+	body := []byte(`{}`)
+	now := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		name    string
+		sentAt  time.Time
+		wantErr error
+	}{
+		{name: "now", sentAt: now},
+		{name: "at the edge of the past", sentAt: now.Add(-tolerance)},
+		{name: "at the edge of the future", sentAt: now.Add(tolerance)},
+		{name: "expired", sentAt: now.Add(-tolerance - time.Second), wantErr: ErrStaleSignature},
+		{name: "long expired", sentAt: now.Add(-24 * time.Hour), wantErr: ErrStaleSignature},
+		{name: "too far in the future", sentAt: now.Add(tolerance + time.Second), wantErr: ErrStaleSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := tt.sentAt.Unix()
+			err := VerifyWebhook(secret, strconv.FormatInt(ts, 10), SignWebhook(secret, ts, body), body, now, tolerance)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// HMAC-SHA256 of "1700000000.{}" with the key "whsec", as computed by
+	// printf '1700000000.{}' | openssl dgst -sha256 -hmac whsec
+	const want = "sha256=7d44587dddbaf4c7f70fef20f48cd594834ffea1641e3ac227b84408298738af"
+
+	if got := SignWebhook("whsec", 1700000000, []byte(`{}`)); got != want {
+		t.Errorf("SignWebhook = %q, want %q", got, want)
+	}
+}
+
+// flipHex returns a hex digit other than c
+func flipHex(c byte) string {
+	if c == '0' {
+		return "1"
+	}
+	return "0"
+}
@@ -0,0 +1,114 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// AccessToken is a long lived personal access token a user creates
+// for scripts and bots. Like refresh tokens only their hash is stored.
+type AccessToken struct {
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"token_hash,omitempty"`
+	Scopes     []string   `json:"scopes"`
+	ID         int        `json:"id,omitempty"`
+	UserID     int        `json:"user_id,omitempty"`
+}
+
+// accessTokenTouchInterval is how stale LastUsedAt may get, so a busy
+// bot doesn't turn every request into a write
+const accessTokenTouchInterval = time.Minute
+
+func (t AccessToken) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(now)
+}
+
+// CreateAccessToken stores a new personal access token for a user
+func (db *DB) CreateAccessToken(userID int, name, token string, scopes []string, expiresAt *time.Time) (AccessToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	accessToken := AccessToken{
+		ID:        db.data.nextID(tableAccessTokens),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: hashToken(token),
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		ExpiresAt: expiresAt,
+	}
+
+	err := db.commit(put(tableAccessTokens, accessToken.ID, accessToken))
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	return accessToken, nil
+}
+
+// UseAccessToken returns the unexpired access token matching token
+// and records that it was used
+func (db *DB) UseAccessToken(token string) (AccessToken, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	id, ok := db.idx.accessTokensByHash[hashToken(token)]
+	if !ok {
+		return AccessToken{}, ErrNotFound
+	}
+	accessToken := db.data.AccessTokens[id]
+
+	now := time.Now().UTC()
+	if accessToken.expired(now) {
+		return AccessToken{}, ErrExpired
+	}
+
+	if accessToken.LastUsedAt != nil && now.Sub(*accessToken.LastUsedAt) < accessTokenTouchInterval {
+		return accessToken, nil
+	}
+	accessToken.LastUsedAt = &now
+
+	// a touch only appends to the log, or every request of a busy
+	// bot would rewrite the snapshot under FlushEveryWrite
+	err := db.commitToLog(put(tableAccessTokens, id, accessToken))
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	return accessToken, nil
+}
+
+// ListAccessTokens returns the access tokens of a user, newest first
+func (db *DB) ListAccessTokens(userID int) ([]AccessToken, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	accessTokens := []AccessToken{}
+	for _, accessToken := range db.data.AccessTokens {
+		if accessToken.UserID == userID {
+			accessTokens = append(accessTokens, accessToken)
+		}
+	}
+
+	slices.SortFunc(accessTokens, func(a, b AccessToken) int {
+		return b.ID - a.ID
+	})
+
+	return accessTokens, nil
+}
+
+// RevokeAccessToken deletes an access token of a user
+func (db *DB) RevokeAccessToken(ID, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	accessToken, ok := db.data.AccessTokens[ID]
+	if !ok || accessToken.UserID != userID {
+		return ErrNotFound
+	}
+
+	return db.commit(del(tableAccessTokens, ID))
+}
@@ -0,0 +1,30 @@
+package database
+
+import "time"
+
+// AuditEvent is a security relevant event, such as a replayed refresh token
+type AuditEvent struct {
+	CreatedAt time.Time `json:"created_at"`
+	Type      string    `json:"type"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	ID        int       `json:"id,omitempty"`
+	UserID    int       `json:"user_id,omitempty"`
+	SessionID int       `json:"session_id,omitempty"`
+}
+
+// RecordAuditEvent appends an event to the audit trail
+func (db *DB) RecordAuditEvent(event AuditEvent) (AuditEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	event.ID = db.data.nextID(tableAudit)
+	event.CreatedAt = time.Now().UTC()
+
+	err := db.commit(put(tableAudit, event.ID, event))
+	if err != nil {
+		return AuditEvent{}, err
+	}
+
+	return event, nil
+}
@@ -0,0 +1,63 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPurgeDeletedChirps(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			kept, err := db.CreateChirp("kept", user.ID)
+			if err != nil {
+				t.Fatalf("CreateChirp: %s", err)
+			}
+			deleted, err := db.CreateChirp("deleted", user.ID)
+			if err != nil {
+				t.Fatalf("CreateChirp: %s", err)
+			}
+			err = db.SoftDeleteChirpByID(deleted.ID, user.ID)
+			if err != nil {
+				t.Fatalf("SoftDeleteChirpByID: %s", err)
+			}
+
+			// still within its restore period
+			n, err := db.PurgeDeletedChirps(time.Now().Add(-time.Hour))
+			if err != nil {
+				t.Fatalf("PurgeDeletedChirps: %s", err)
+			}
+			if n != 0 {
+				t.Errorf("purged %d chirps within the restore period, want none", n)
+			}
+
+			n, err = db.PurgeDeletedChirps(time.Now().Add(time.Second))
+			if err != nil {
+				t.Fatalf("PurgeDeletedChirps: %s", err)
+			}
+			if n != 1 {
+				t.Errorf("purged %d chirps, want 1", n)
+			}
+
+			_, err = db.GetChirpByID(deleted.ID)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetChirpByID(purged): err = %v, want ErrNotFound", err)
+			}
+			_, err = db.RestoreChirpByID(deleted.ID, user.ID, time.Hour)
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("RestoreChirpByID(purged): err = %v, want ErrNotFound", err)
+			}
+			_, err = db.GetChirpByID(kept.ID)
+			if err != nil {
+				t.Errorf("GetChirpByID(kept): %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ChirpsQuery selects a page of chirps
+type ChirpsQuery struct {
+	// AuthorID only returns chirps of this author when set
+	AuthorID int
+	// Sort is "asc" or "desc" by ID, which is also creation order
+	Sort string
+	// Limit caps the page size, 0 means no limit
+	Limit int
+	// Cursor continues after the page that returned it as NextCursor
+	Cursor string
+	// Since only returns chirps created at or after it when set
+	Since time.Time
+	// Until only returns chirps created before it when set
+	Until time.Time
+}
+
+// ChirpsPage is one page of GetChirps
+type ChirpsPage struct {
+	Chirps []Chirp
+	// NextCursor is empty on the last page
+	NextCursor string
+}
+
+// afterID returns the ID the page starts after, or 0 for the first page.
+// Pages are keyed on ID rather than offset, so chirps created while a
+// client is paging never shift or repeat entries.
+func (q ChirpsQuery) afterID() (int, error) {
+	if q.Cursor == "" {
+		return 0, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return 0, ErrInvalidCursor
+	}
+
+	sort, id, found := strings.Cut(string(raw), ":")
+	if !found || sort != q.sort() {
+		return 0, ErrInvalidCursor
+	}
+
+	lastID, err := strconv.Atoi(id)
+	if err != nil || lastID <= 0 {
+		return 0, ErrInvalidCursor
+	}
+
+	return lastID, nil
+}
+
+func (q ChirpsQuery) sort() string {
+	if q.Sort == "desc" {
+		return "desc"
+	}
+	return "asc"
+}
+
+// page trims chirps, fetched with one extra row past Limit, to the page
+// and sets the cursor if there's more
+func (q ChirpsQuery) page(chirps []Chirp) ChirpsPage {
+	if q.Limit <= 0 || len(chirps) <= q.Limit {
+		return ChirpsPage{Chirps: chirps}
+	}
+
+	chirps = chirps[:q.Limit]
+	last := chirps[len(chirps)-1]
+
+	return ChirpsPage{
+		Chirps:     chirps,
+		NextCursor: base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%s:%d", q.sort(), last.ID)),
+	}
+}
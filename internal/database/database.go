@@ -5,58 +5,173 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"sort"
 	"sync"
 	"time"
 )
 
 type Chirp struct {
-	Body     string `json:"body,omitempty"`
-	ID       int    `json:"id,omitempty"`
-	AuthorID int    `json:"author_id,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	Body      string     `json:"body,omitempty"`
+	ID        int        `json:"id,omitempty"`
+	AuthorID  int        `json:"author_id,omitempty"`
 }
 
 type Token struct {
 	TokenExpirationDate time.Time `json:"token_expiration_date,omitempty"`
-	RefreshToken        string    `json:"refresh_token,omitempty"`
-	UserID              int       `json:"user_id,omitempty"`
+	// TokenHash is the SHA-256 of the refresh token, the token
+	// itself is only ever known to the client holding it
+	TokenHash string `json:"token_hash,omitempty"`
+	// RefreshToken is the plaintext token of files written before
+	// schema version 4, which hashes it into TokenHash
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ID           int    `json:"id,omitempty"`
+	UserID       int    `json:"user_id,omitempty"`
+	SessionID    int    `json:"session_id,omitempty"`
+
+	// RotatedAt is set once the token was exchanged for a new one.
+	// It's kept until it expires so a replay can be detected.
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+}
+
+// Session is one login of a user, on one device.
+// Its refresh tokens live in Tokens.
+type Session struct {
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	ID         int       `json:"id,omitempty"`
+	UserID     int       `json:"user_id,omitempty"`
 }
 
 type User struct {
-	Email       string `json:"email,omitempty"`
-	Password    string `json:"password,omitempty"`
-	ID          int    `json:"id,omitempty"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Email     string    `json:"email,omitempty"`
+	Password  string    `json:"password,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	ID        int       `json:"id,omitempty"`
+
+	// Subscription is the user's Chirpy Red subscription, if they ever had one
+	Subscription *Subscription `json:"subscription,omitempty"`
+	// LegacyChirpyRed is the flag of files written before schema
+	// version 6, which turns it into a Subscription
+	LegacyChirpyRed bool `json:"is_chirpy_red,omitempty"`
+
+	// EmailVerified is set once the user proved they own Email
+	// and reset whenever it changes
+	EmailVerified bool `json:"email_verified,omitempty"`
+
+	// TOTPSecret is set on enrollment and only asked for once
+	// the user confirmed it, which sets TOTPEnabled
+	TOTPSecret  string `json:"totp_secret,omitempty"`
+	TOTPEnabled bool   `json:"totp_enabled,omitempty"`
+	// TOTPLastStep is the time step of the last accepted code,
+	// so the same code can't log in twice
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+	// RecoveryCodes are the hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+
+	// FailedLogins counts the failed logins since the last successful
+	// one, LastFailedLoginAt is when the latest of them happened
+	FailedLogins      int        `json:"failed_logins,omitempty"`
+	LastFailedLoginAt *time.Time `json:"last_failed_login_at,omitempty"`
+}
+
+// Roles a user can have. Every user has RoleUser.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// HasRole reports whether the user has any of roles
+func (u User) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if slices.Contains(u.Roles, role) {
+			return true
+		}
+	}
+	return false
 }
 
 type DB struct {
 	mux  *sync.RWMutex
 	path string
+
+	// data is the whole database, loaded once in NewDB. Every
+	// mutation is in the write-ahead log before it lands here,
+	// and the flush policy decides when a snapshot is written.
+	data   DBStructure
+	idx    indexes
+	dirty  bool
+	policy FlushPolicy
+	stop   chan struct{}
+	done   chan struct{}
+
+	// migrations are the ones loading the file ran
+	migrations []Migration
 }
 
 type DBStructure struct {
+	// SchemaVersion is the last migration applied to the file
+	SchemaVersion int `json:"schema_version"`
+
 	Chirps map[int]Chirp `json:"chirps"`
 	Users  map[int]User  `json:"users"`
 	Tokens map[int]Token `json:"tokens"`
+
+	Sessions    map[int]Session    `json:"sessions"`
+	AuditEvents map[int]AuditEvent `json:"audit_events"`
+
+	AccessTokens map[int]AccessToken `json:"access_tokens"`
+
+	WebhookEvents map[int]WebhookEvent `json:"webhook_events"`
+
+	ScheduledChirps map[int]ScheduledChirp `json:"scheduled_chirps"`
+
+	// ProcessedWebhooks is migrated into WebhookEvents
+	ProcessedWebhooks map[int]ProcessedWebhook `json:"processed_webhooks,omitempty"`
+
+	// Sequences holds the last ID handed out per table,
+	// so IDs of deleted records are never reused
+	Sequences map[string]int `json:"sequences"`
 }
 
 var (
-	ErrNotFound     = errors.New("record not found")
-	ErrUnauthorized = errors.New("can't do that")
+	ErrNotFound      = errors.New("record not found")
+	ErrUnauthorized  = errors.New("can't do that")
+	ErrAlreadyExists = errors.New("record already exists")
+	ErrExpired       = errors.New("record expired")
+	ErrTokenReused   = errors.New("token already used")
 )
 
-// NewDB creates a new database connection
-// and creates the database file if it doesn't exist
-func NewDB(path string) (*DB, error) {
+// NewDB creates a new database connection,
+// creates the database file if it doesn't exist
+// and loads it into memory
+func NewDB(path string, policy FlushPolicy) (*DB, error) {
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:   path,
+		mux:    &sync.RWMutex{},
+		policy: policy,
 	}
 	err := db.ensureDB()
 	if err != nil {
 		return nil, err
 	}
 
+	err = db.load()
+	if err != nil {
+		return nil, err
+	}
+
+	db.startFlusher()
+
 	return db, nil
 }
 
@@ -65,24 +180,17 @@ func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Chirp{}, err
-	}
-
-	if dbStructure.Chirps == nil {
-		dbStructure.Chirps = make(map[int]Chirp)
-	}
-
-	id := len(dbStructure.Chirps) + 1
+	now := time.Now().UTC()
+	id := db.data.nextID(tableChirps)
 	chirp := Chirp{
-		ID:       id,
-		Body:     body,
-		AuthorID: userID,
+		ID:        id,
+		Body:      body,
+		AuthorID:  userID,
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
-	dbStructure.Chirps[id] = chirp
 
-	err = db.writeDB(dbStructure)
+	err := db.commit(put(tableChirps, id, chirp))
 	if err != nil {
 		return Chirp{}, err
 	}
@@ -90,44 +198,53 @@ func (db *DB) CreateChirp(body string, userID int) (Chirp, error) {
 	return chirp, nil
 }
 
-// GetChirps returns all chirps in the database
-func (db *DB) GetChirps(authorID int, sorting string) ([]Chirp, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	dbStructure, err := db.loadDB()
+// GetChirps returns a page of chirps from the database
+func (db *DB) GetChirps(q ChirpsQuery) (ChirpsPage, error) {
+	afterID, err := q.afterID()
 	if err != nil {
-		return nil, err
+		return ChirpsPage{}, err
 	}
+	desc := q.sort() == "desc"
+
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
 	// Create a slice to hold the chirps
-	chirps := make([]Chirp, 0, len(dbStructure.Chirps))
+	chirps := make([]Chirp, 0, len(db.data.Chirps))
 
-	// Extract chirps from the map into the slice
-	for _, chirp := range dbStructure.Chirps {
+	// Extract the matching chirps from the map into the slice
+	for _, chirp := range db.data.Chirps {
+		if chirp.DeletedAt != nil {
+			continue
+		}
+		if q.AuthorID != 0 && chirp.AuthorID != q.AuthorID {
+			continue
+		}
+		if afterID != 0 && (desc && chirp.ID >= afterID || !desc && chirp.ID <= afterID) {
+			continue
+		}
+		if !q.Since.IsZero() && chirp.CreatedAt.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && !chirp.CreatedAt.Before(q.Until) {
+			continue
+		}
 		chirps = append(chirps, chirp)
 	}
 
 	// Sort the slice based on the ID field
 	sort.Slice(chirps, func(i, j int) bool {
-		if sorting == "desc" {
+		if desc {
 			return chirps[i].ID > chirps[j].ID
 		}
 		return chirps[i].ID < chirps[j].ID
 	})
 
-	if authorID != 0 {
-		// Filter the slice based on the author ID
-		filteredChirps := make([]Chirp, 0, len(chirps))
-		for _, chirp := range chirps {
-			if chirp.AuthorID == authorID {
-				filteredChirps = append(filteredChirps, chirp)
-			}
-		}
-		chirps = filteredChirps
+	if q.Limit > 0 && len(chirps) > q.Limit+1 {
+		chirps = chirps[:q.Limit+1]
 	}
 
-	return chirps, nil
+	return q.page(chirps), nil
 }
 
 // GetChirpByID returns the chirp of the given ID from the database
@@ -135,48 +252,158 @@ func (db *DB) GetChirpByID(ID int) (Chirp, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
-	var chirp Chirp
+	chirp, ok := db.data.Chirps[ID]
+	if !ok || chirp.DeletedAt != nil {
+		return Chirp{}, ErrNotFound
+	}
+
+	return chirp, nil
+}
 
-	dbStructure, err := db.loadDB()
+// DeleteChirpByID removes the chirp of the given ID from the database
+func (db *DB) DeleteChirpByID(ID, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	_, err := db.ownedChirp(ID, userID)
 	if err != nil {
-		return chirp, err
+		return err
 	}
 
-	chirp, ok := dbStructure.Chirps[ID]
-	if !ok {
-		return chirp, ErrNotFound
+	return db.commit(del(tableChirps, ID))
+}
+
+// RemoveChirpByID removes the chirp of the given ID
+// whoever wrote it, for moderation
+func (db *DB) RemoveChirpByID(ID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Chirps[ID]; !ok {
+		return ErrNotFound
+	}
+
+	return db.commit(del(tableChirps, ID))
+}
+
+// SoftDeleteChirpByID hides the chirp of the given ID
+// until it is restored with RestoreChirpByID
+func (db *DB) SoftDeleteChirpByID(ID, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	chirp, err := db.ownedChirp(ID, userID)
+	if err != nil {
+		return err
+	}
+	if chirp.DeletedAt != nil {
+		return ErrNotFound
+	}
+
+	now := time.Now().UTC()
+	chirp.DeletedAt = &now
+
+	return db.commit(put(tableChirps, ID, chirp))
+}
+
+// RestoreChirpByID brings back a soft deleted chirp
+// if it was deleted less than gracePeriod ago
+func (db *DB) RestoreChirpByID(ID, userID int, gracePeriod time.Duration) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	chirp, err := db.ownedChirp(ID, userID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.DeletedAt == nil {
+		return Chirp{}, ErrNotFound
+	}
+	if time.Since(*chirp.DeletedAt) > gracePeriod {
+		return Chirp{}, ErrExpired
+	}
+
+	chirp.DeletedAt = nil
+
+	err = db.commit(put(tableChirps, ID, chirp))
+	if err != nil {
+		return Chirp{}, err
 	}
 
 	return chirp, nil
 }
 
-// DeleteChirpByID returns the chirp of the given ID from the database
-func (db *DB) DeleteChirpByID(ID, userID int) error {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
+// PurgeDeletedChirps removes the chirps soft deleted before
+// deletedBefore, returning how many it removed
+func (db *DB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	var chirp Chirp
+	var entries []walEntry
+	for id, chirp := range db.data.Chirps {
+		if chirp.DeletedAt != nil && chirp.DeletedAt.Before(deletedBefore) {
+			entries = append(entries, del(tableChirps, id))
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
 
-	dbStructure, err := db.loadDB()
+	err := db.commit(entries...)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	chirp, ok := dbStructure.Chirps[ID]
+	return len(entries), nil
+}
+
+// UpdateChirp replaces the body of a chirp of userID
+func (db *DB) UpdateChirp(ID, userID int, body string) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	chirp, err := db.ownedChirp(ID, userID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.DeletedAt != nil {
+		return Chirp{}, ErrNotFound
+	}
+
+	chirp.Body = body
+	chirp.UpdatedAt = time.Now().UTC()
+
+	err = db.commit(put(tableChirps, ID, chirp))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+// ownedChirp returns the chirp of the given ID, deleted or not,
+// if it belongs to userID
+func (db *DB) ownedChirp(ID, userID int) (Chirp, error) {
+	chirp, ok := db.data.Chirps[ID]
 	if !ok {
-		return ErrNotFound
+		return Chirp{}, ErrNotFound
 	}
 
 	if chirp.AuthorID != userID {
-		return ErrUnauthorized
+		return Chirp{}, ErrUnauthorized
 	}
 
-	return nil
+	return chirp, nil
+}
+
+// nextID returns the ID the next record of table will get
+func (s *DBStructure) nextID(table string) int {
+	return s.Sequences[table] + 1
 }
 
 // ensureDB creates a new database file if it doesn't exist
 func (db *DB) ensureDB() error {
-	dbStruct := new(DBStructure)
+	dbStruct := &DBStructure{SchemaVersion: latestSchemaVersion()}
 	_, err := os.Stat(db.path)
 	if errors.Is(err, os.ErrNotExist) {
 		return db.writeDB(*dbStruct)
@@ -188,7 +415,6 @@ func (db *DB) ensureDB() error {
 func (db *DB) loadDB() (DBStructure, error) {
 	file, err := os.ReadFile(db.path)
 	if err != nil {
-		fmt.Println("ERROR ON READ")
 		return DBStructure{}, err
 	}
 
@@ -199,22 +425,20 @@ func (db *DB) loadDB() (DBStructure, error) {
 
 	err = json.Unmarshal(file, &dbStruct)
 	if err != nil {
-		fmt.Println("ERROR UNMARSHALLING")
-
-		return DBStructure{}, err
+		return DBStructure{}, fmt.Errorf("decoding %s: %w", db.path, err)
 	}
 
 	return dbStruct, nil
 }
 
-// writeDB writes the database file to disk
+// writeDB atomically replaces the database file on disk
 func (db *DB) writeDB(dbStructure DBStructure) error {
 	file, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(db.path, file, 0644)
+	return writeFileAtomic(db.path, file, 0644)
 }
 
 // CreateUser creates a new user and saves it to disk
@@ -222,32 +446,22 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
+	if _, exists := db.idx.usersByEmail[emailKey(email)]; exists {
+		return User{}, ErrAlreadyExists
 	}
 
-	if dbStructure.Users == nil {
-		dbStructure.Users = make(map[int]User)
-	}
-
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return User{}, errors.New("somethig went wrong")
-		}
-	}
-
-	id := len(dbStructure.Users) + 1
+	now := time.Now().UTC()
+	id := db.data.nextID(tableUsers)
 	user := User{
-		ID:          id,
-		Email:       email,
-		Password:    password,
-		IsChirpyRed: false,
+		ID:        id,
+		Email:     email,
+		Password:  password,
+		Roles:     []string{RoleUser},
+		CreatedAt: now,
+		UpdatedAt: now,
 	}
 
-	dbStructure.Users[id] = user
-
-	err = db.writeDB(dbStructure)
+	err := db.commit(put(tableUsers, id, user))
 	if err != nil {
 		return User{}, err
 	}
@@ -255,58 +469,30 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 	return user, nil
 }
 
-// GetUser retrieves the user for a given email
-func (db *DB) GetUser(email string) (User, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
+// GetUserByID retrieves the user of the given ID
+func (db *DB) GetUserByID(ID int) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	if dbStructure.Users == nil {
+	user, ok := db.data.Users[ID]
+	if !ok {
 		return User{}, ErrNotFound
 	}
 
-	for _, user := range dbStructure.Users {
-		if user.Email == email {
-			return user, nil
-		}
-	}
-
-	return User{}, ErrNotFound
+	return user, nil
 }
 
-// UpgradeUser upgrades to red a user with a given ID
-func (db *DB) UpgradeUser(ID int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	if dbStructure.Users == nil {
-		return ErrNotFound
-	}
-
-	user, exists := dbStructure.Users[ID]
-	if !exists {
-		return ErrNotFound
-	}
-
-	user.IsChirpyRed = true
-
-	dbStructure.Users[ID] = user
+// GetUser retrieves the user for a given email
+func (db *DB) GetUser(email string) (User, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+	id, ok := db.idx.usersByEmail[emailKey(email)]
+	if !ok {
+		return User{}, ErrNotFound
 	}
 
-	return nil
+	return db.data.Users[id], nil
 }
 
 // UpdateUser updates a given user
@@ -314,28 +500,24 @@ func (db *DB) UpdateUser(ID int, email, password string) (User, error) {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return User{}, err
-	}
-
-	if dbStructure.Users == nil {
+	user, exists := db.data.Users[ID]
+	if !exists {
 		return User{}, ErrNotFound
 	}
 
-	user, exists := dbStructure.Users[ID]
-	if !exists {
-		return User{}, ErrNotFound
+	if otherID, taken := db.idx.usersByEmail[emailKey(email)]; taken && otherID != ID {
+		return User{}, ErrAlreadyExists
 	}
 
 	// Update the user
+	if emailKey(email) != emailKey(user.Email) {
+		user.EmailVerified = false
+	}
 	user.Email = email
 	user.Password = password
+	user.UpdatedAt = time.Now().UTC()
 
-	// Update the map
-	dbStructure.Users[ID] = user
-
-	err = db.writeDB(dbStructure)
+	err := db.commit(put(tableUsers, ID, user))
 	if err != nil {
 		return User{}, err
 	}
@@ -343,119 +525,82 @@ func (db *DB) UpdateUser(ID int, email, password string) (User, error) {
 	return user, nil
 }
 
-// GetToken get's a token based on it's value
-func (db *DB) GetToken(refreshToken string) (Token, error) {
+// RehashPassword replaces the password hash of a given user with
+// newHash of the same password, unless it changed from oldHash since
+func (db *DB) RehashPassword(ID int, oldHash, newHash string) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Token{}, err
+	user, exists := db.data.Users[ID]
+	if !exists || user.Password != oldHash {
+		return ErrNotFound
 	}
 
-	if dbStructure.Tokens == nil {
-		return Token{}, ErrNotFound
-	}
+	// the password itself didn't change, so UpdatedAt stays
+	user.Password = newHash
 
-	for _, token := range dbStructure.Tokens {
-		if token.RefreshToken == refreshToken {
-			return token, nil
-		}
-	}
-
-	return Token{}, ErrNotFound
+	return db.commit(put(tableUsers, ID, user))
 }
 
-// UpdateUserRefreshToken updates a given user refreshToken
-func (db *DB) UpdateUserRefreshToken(userID int, refreshToken string, tokenExpDate time.Time) (Token, error) {
+// ResetPassword replaces the password hash of a given user with
+// newHash, unless it changed from oldHash since, and revokes their
+// sessions and access tokens in the same commit. Of two resets with the
+// same token only the first one gets through.
+func (db *DB) ResetPassword(ID int, oldHash, newHash string) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return Token{}, err
-	}
-
-	if dbStructure.Tokens == nil {
-		token := Token{
-			UserID:              userID,
-			RefreshToken:        refreshToken,
-			TokenExpirationDate: tokenExpDate,
-		}
-
-		dbStructure.Tokens = make(map[int]Token)
-		dbStructure.Tokens[userID] = token
-
-		err = db.writeDB(dbStructure)
-		if err != nil {
-			return Token{}, err
-		}
-
-		return token, nil
+	user, exists := db.data.Users[ID]
+	if !exists || user.Password != oldHash {
+		return ErrNotFound
 	}
 
-	dbToken := Token{}
+	user.Password = newHash
+	user.UpdatedAt = time.Now().UTC()
 
-	for _, token := range dbStructure.Tokens {
-		if token.UserID == userID {
-			dbToken = token
+	entries := []walEntry{put(tableUsers, ID, user)}
+	entries = append(entries, db.sessionDeletes(func(s Session) bool { return s.UserID == ID })...)
+	for id, accessToken := range db.data.AccessTokens {
+		if accessToken.UserID == ID {
+			entries = append(entries, del(tableAccessTokens, id))
 		}
 	}
 
-	if dbToken.UserID == 0 {
-		token := Token{
-			UserID:              userID,
-			RefreshToken:        refreshToken,
-			TokenExpirationDate: tokenExpDate,
-		}
-
-		dbStructure.Tokens[userID] = token
+	return db.commit(entries...)
+}
 
-		err = db.writeDB(dbStructure)
-		if err != nil {
-			return Token{}, err
-		}
+// SetUserRoles replaces the roles of a given user
+func (db *DB) SetUserRoles(ID int, roles []string) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-		return token, nil
+	user, exists := db.data.Users[ID]
+	if !exists {
+		return User{}, ErrNotFound
 	}
 
-	dbToken.RefreshToken = refreshToken
-	dbToken.TokenExpirationDate = tokenExpDate
+	user.Roles = roles
+	user.UpdatedAt = time.Now().UTC()
 
-	dbStructure.Tokens[userID] = dbToken
-
-	err = db.writeDB(dbStructure)
+	err := db.commit(put(tableUsers, ID, user))
 	if err != nil {
-		return Token{}, err
+		return User{}, err
 	}
 
-	return dbToken, nil
+	return user, nil
 }
 
-// RevokeToken revokes a given refresh token
-func (db *DB) RevokeToken(refreshToken string) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
+// MarkEmailVerified records that a given user owns their email
+func (db *DB) MarkEmailVerified(ID int) (User, error) {
+	var user User
+	err := db.updateUser(ID, func(u *User) error {
+		u.EmailVerified = true
+		user = *u
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-
-	if dbStructure.Tokens == nil {
-		return ErrNotFound
-	}
-
-	for i, token := range dbStructure.Tokens {
-		if token.RefreshToken == refreshToken {
-			delete(dbStructure.Tokens, i)
-			err = db.writeDB(dbStructure)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
+		return User{}, err
 	}
 
-	return ErrNotFound
+	return user, nil
 }
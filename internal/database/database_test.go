@@ -0,0 +1,108 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	benchChirps = 1000
+	benchTokens = 100
+)
+
+// populatedDB returns a snapshotted store with benchChirps chirps and
+// benchTokens refresh tokens, along with the tokens
+func populatedDB(b *testing.B) (*DB, []string) {
+	b.Helper()
+
+	db, err := NewDB(filepath.Join(b.TempDir(), "database.json"), FlushPolicy{Mode: FlushOnClose})
+	if err != nil {
+		b.Fatalf("NewDB: %s", err)
+	}
+
+	user, err := db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		b.Fatalf("CreateUser: %s", err)
+	}
+	for i := range benchChirps {
+		_, err = db.CreateChirp(fmt.Sprintf("chirp %d", i), user.ID)
+		if err != nil {
+			b.Fatalf("CreateChirp: %s", err)
+		}
+	}
+
+	tokens := make([]string, benchTokens)
+	for i := range tokens {
+		tokens[i] = fmt.Sprintf("refresh-token-%d", i)
+		_, _, err = db.CreateSession(user.ID, "bench", "127.0.0.1", tokens[i], time.Now().Add(time.Hour))
+		if err != nil {
+			b.Fatalf("CreateSession: %s", err)
+		}
+	}
+
+	db.mux.Lock()
+	err = db.flush()
+	db.mux.Unlock()
+	if err != nil {
+		b.Fatalf("flush: %s", err)
+	}
+
+	return db, tokens
+}
+
+func BenchmarkGetChirps(b *testing.B) {
+	db, _ := populatedDB(b)
+
+	b.ResetTimer()
+	for range b.N {
+		_, err := db.GetChirps(ChirpsQuery{Limit: 50})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetChirpByID(b *testing.B) {
+	db, _ := populatedDB(b)
+
+	b.ResetTimer()
+	for i := range b.N {
+		_, err := db.GetChirpByID(i%benchChirps + 1)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetToken(b *testing.B) {
+	db, tokens := populatedDB(b)
+
+	b.ResetTimer()
+	for i := range b.N {
+		_, err := db.GetToken(tokens[i%len(tokens)])
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetChirpByIDFromFile is the baseline of reads before the
+// in-memory structure, which decoded the whole file every time
+func BenchmarkGetChirpByIDFromFile(b *testing.B) {
+	db, _ := populatedDB(b)
+
+	b.ResetTimer()
+	for i := range b.N {
+		db.mux.RLock()
+		s, err := db.loadDB()
+		db.mux.RUnlock()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, ok := s.Chirps[i%benchChirps+1]; !ok {
+			b.Fatal("chirp not found")
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// FlushMode decides when the in-memory database is snapshotted to disk.
+// Mutations are always in the write-ahead log first, so a crash between
+// snapshots loses nothing; the mode only trades write latency against
+// how much log has to be replayed on startup.
+type FlushMode int
+
+const (
+	// FlushEveryWrite writes a snapshot after every mutation
+	FlushEveryWrite FlushMode = iota
+	// FlushInterval writes a snapshot every Interval if anything changed
+	FlushInterval
+	// FlushOnClose only writes a snapshot when the database is closed
+	FlushOnClose
+)
+
+type FlushPolicy struct {
+	Mode     FlushMode
+	Interval time.Duration
+
+	// ErrorLog gets the snapshots that failed with nobody to return
+	// the error to. They're retried on the next flush, and the log
+	// covers for them until then. Nil discards them.
+	ErrorLog *log.Logger
+}
+
+// ParseFlushMode parses the names accepted in configuration
+func ParseFlushMode(s string) (FlushMode, error) {
+	switch s {
+	case "", "write":
+		return FlushEveryWrite, nil
+	case "interval":
+		return FlushInterval, nil
+	case "shutdown":
+		return FlushOnClose, nil
+	default:
+		return 0, fmt.Errorf("unknown flush mode %q", s)
+	}
+}
+
+// flush writes the in-memory database to disk and empties the log.
+// The caller must hold the write lock.
+func (db *DB) flush() error {
+	if !db.dirty {
+		return nil
+	}
+
+	err := db.writeDB(db.data)
+	if err != nil {
+		return err
+	}
+	db.dirty = false
+
+	err = afterSnapshot()
+	if err != nil {
+		return err
+	}
+	return db.truncateLog()
+}
+
+// logFlushError reports a snapshot that failed in the background
+func (db *DB) logFlushError(err error) {
+	if db.policy.ErrorLog != nil {
+		db.policy.ErrorLog.Printf("Error flushing %s: %s", db.path, err)
+	}
+}
+
+// startFlusher starts the background snapshots for FlushInterval
+func (db *DB) startFlusher() {
+	if db.policy.Mode != FlushInterval || db.policy.Interval <= 0 {
+		return
+	}
+
+	db.stop = make(chan struct{})
+	db.done = make(chan struct{})
+
+	go func() {
+		defer close(db.done)
+
+		ticker := time.NewTicker(db.policy.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				db.mux.Lock()
+				err := db.flush()
+				db.mux.Unlock()
+				if err != nil {
+					db.logFlushError(err)
+				}
+			case <-db.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the background flusher and writes any pending changes
+func (db *DB) Close() error {
+	if db.stop != nil {
+		close(db.stop)
+		<-db.done
+		db.stop = nil
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.flush()
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// backends opens a store of each kind at a path that survives reopening
+var backends = map[string]func(t *testing.T, dir string) Store{
+	"json": func(t *testing.T, dir string) Store {
+		t.Helper()
+
+		db, err := NewDB(filepath.Join(dir, "database.json"), FlushPolicy{Mode: FlushEveryWrite})
+		if err != nil {
+			t.Fatalf("NewDB: %s", err)
+		}
+		return db
+	},
+	"sqlite": func(t *testing.T, dir string) Store {
+		t.Helper()
+
+		db, err := NewSQLiteDB(filepath.Join(dir, "database.sqlite"))
+		if err != nil {
+			t.Fatalf("NewSQLiteDB: %s", err)
+		}
+		return db
+	},
+}
+
+func TestIDsAreNeverReused(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := open(t, dir)
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+
+			seen := make(map[int]bool)
+			create := func() int {
+				t.Helper()
+
+				chirp, err := db.CreateChirp("chirp", user.ID)
+				if err != nil {
+					t.Fatalf("CreateChirp: %s", err)
+				}
+				if seen[chirp.ID] {
+					t.Fatalf("chirp ID %d was handed out twice", chirp.ID)
+				}
+				seen[chirp.ID] = true
+				return chirp.ID
+			}
+
+			first := create()
+			second := create()
+			err = db.DeleteChirpByID(second, user.ID)
+			if err != nil {
+				t.Fatalf("DeleteChirpByID: %s", err)
+			}
+			third := create()
+			err = db.RemoveChirpByID(first)
+			if err != nil {
+				t.Fatalf("RemoveChirpByID: %s", err)
+			}
+			err = db.DeleteChirpByID(third, user.ID)
+			if err != nil {
+				t.Fatalf("DeleteChirpByID: %s", err)
+			}
+
+			// with every chirp deleted, the sequence has to survive a restart
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+			db = open(t, dir)
+			defer db.Close()
+
+			fourth := create()
+			if fourth <= third {
+				t.Errorf("chirp ID after deleting them all and reopening = %d, want more than %d", fourth, third)
+			}
+		})
+	}
+}
+
+func TestMigratedSequencesStartAfterTheHighestID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	// a file from before sequences, with a gap where chirp 2 was deleted
+	err := os.WriteFile(path, []byte(`{
+	"chirps": {"1": {"id": 1, "body": "one", "author_id": 1}, "3": {"id": 3, "body": "three", "author_id": 1}},
+	"users": {"1": {"id": 1, "email": "a@b.com", "password": "hash"}}
+}`), 0644)
+	if err != nil {
+		t.Fatalf("writing unversioned file: %s", err)
+	}
+
+	db, err := NewDB(path, FlushPolicy{Mode: FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	defer db.Close()
+	if n := len(db.Migrations()); n != latestSchemaVersion() {
+		t.Errorf("ran %d migrations on an unversioned file, want %d", n, latestSchemaVersion())
+	}
+
+	chirp, err := db.CreateChirp("four", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %s", err)
+	}
+	if chirp.ID != 4 {
+		t.Errorf("chirp ID = %d, want 4", chirp.ID)
+	}
+
+	user, err := db.CreateUser("c@d.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	if user.ID != 2 {
+		t.Errorf("user ID = %d, want 2", user.ID)
+	}
+}
+
+func TestMigrationsRunOnce(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			// a new JSON file starts at the latest version, a new
+			// SQLite database is migrated from nothing
+			db := open(t, dir)
+			migrations := db.Migrations()
+			for i := 1; i < len(migrations); i++ {
+				if migrations[i].Version <= migrations[i-1].Version {
+					t.Errorf("migration %d ran after %d", migrations[i].Version, migrations[i-1].Version)
+				}
+			}
+			err := db.Close()
+			if err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+
+			db = open(t, dir)
+			defer db.Close()
+			if migrations := db.Migrations(); len(migrations) != 0 {
+				t.Errorf("reopening the store ran %+v, want nothing", migrations)
+			}
+		})
+	}
+}
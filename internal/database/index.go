@@ -0,0 +1,108 @@
+package database
+
+import (
+	"strings"
+)
+
+// indexes are lookups over DB.data that aren't persisted. They're
+// rebuilt on load and kept in sync by apply, so every mutation that
+// goes through commit keeps them current.
+type indexes struct {
+	// usersByEmail maps a lower-cased email to a user ID
+	usersByEmail map[string]int
+	// tokensByHash maps Token.TokenHash to its key in Tokens
+	tokensByHash map[string]int
+	// accessTokensByHash maps AccessToken.TokenHash to its key in AccessTokens
+	accessTokensByHash map[string]int
+	// webhookEventsByDelivery maps the source and delivery ID of a
+	// WebhookEvent to its key in WebhookEvents
+	webhookEventsByDelivery map[string]int
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// rebuildIndexes recreates every index from db.data
+func (db *DB) rebuildIndexes() {
+	db.idx = indexes{
+		usersByEmail: make(map[string]int, len(db.data.Users)),
+		tokensByHash: make(map[string]int, len(db.data.Tokens)),
+
+		accessTokensByHash: make(map[string]int, len(db.data.AccessTokens)),
+
+		webhookEventsByDelivery: make(map[string]int, len(db.data.WebhookEvents)),
+	}
+
+	for id, user := range db.data.Users {
+		db.idx.usersByEmail[emailKey(user.Email)] = id
+	}
+	for id, token := range db.data.Tokens {
+		db.idx.tokensByHash[token.TokenHash] = id
+	}
+	for id, accessToken := range db.data.AccessTokens {
+		db.idx.accessTokensByHash[accessToken.TokenHash] = id
+	}
+	for id, webhookEvent := range db.data.WebhookEvents {
+		if webhookEvent.DeliveryID != "" {
+			db.idx.webhookEventsByDelivery[deliveryKey(webhookEvent.Source, webhookEvent.DeliveryID)] = id
+		}
+	}
+}
+
+// apply applies an entry to db.data and updates the indexes
+func (db *DB) apply(e walEntry) error {
+	db.unindex(e.Table, e.ID)
+
+	err := db.data.apply(e)
+	if err != nil {
+		return err
+	}
+
+	db.index(e.Table, e.ID)
+	return nil
+}
+
+// unindex drops the index entries of the record currently at table/id
+func (db *DB) unindex(table string, id int) {
+	switch table {
+	case tableUsers:
+		if user, ok := db.data.Users[id]; ok {
+			delete(db.idx.usersByEmail, emailKey(user.Email))
+		}
+	case tableTokens:
+		if token, ok := db.data.Tokens[id]; ok {
+			delete(db.idx.tokensByHash, token.TokenHash)
+		}
+	case tableAccessTokens:
+		if accessToken, ok := db.data.AccessTokens[id]; ok {
+			delete(db.idx.accessTokensByHash, accessToken.TokenHash)
+		}
+	case tableWebhookEvents:
+		if webhookEvent, ok := db.data.WebhookEvents[id]; ok && webhookEvent.DeliveryID != "" {
+			delete(db.idx.webhookEventsByDelivery, deliveryKey(webhookEvent.Source, webhookEvent.DeliveryID))
+		}
+	}
+}
+
+// index adds the index entries of the record currently at table/id
+func (db *DB) index(table string, id int) {
+	switch table {
+	case tableUsers:
+		if user, ok := db.data.Users[id]; ok {
+			db.idx.usersByEmail[emailKey(user.Email)] = id
+		}
+	case tableTokens:
+		if token, ok := db.data.Tokens[id]; ok {
+			db.idx.tokensByHash[token.TokenHash] = id
+		}
+	case tableAccessTokens:
+		if accessToken, ok := db.data.AccessTokens[id]; ok {
+			db.idx.accessTokensByHash[accessToken.TokenHash] = id
+		}
+	case tableWebhookEvents:
+		if webhookEvent, ok := db.data.WebhookEvents[id]; ok && webhookEvent.DeliveryID != "" {
+			db.idx.webhookEventsByDelivery[deliveryKey(webhookEvent.Source, webhookEvent.DeliveryID)] = id
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package database
+
+import (
+	"time"
+)
+
+// RecordLoginFailure counts a failed login of a given user, returning
+// the user with the updated count. When the last failure was before
+// forgetBefore, the count starts over.
+func (db *DB) RecordLoginFailure(ID int, forgetBefore time.Time) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, exists := db.data.Users[ID]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+
+	// not a change to the account, so UpdatedAt stays
+	now := time.Now().UTC()
+	if user.LastFailedLoginAt == nil || user.LastFailedLoginAt.Before(forgetBefore) {
+		user.FailedLogins = 0
+	}
+	user.FailedLogins++
+	user.LastFailedLoginAt = &now
+
+	err := db.commit(put(tableUsers, ID, user))
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// ResetLoginFailures forgets the failed logins of a given user,
+// lifting any lockout
+func (db *DB) ResetLoginFailures(ID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, exists := db.data.Users[ID]
+	if !exists {
+		return ErrNotFound
+	}
+	if user.FailedLogins == 0 && user.LastFailedLoginAt == nil {
+		return nil
+	}
+
+	user.FailedLogins = 0
+	user.LastFailedLoginAt = nil
+
+	return db.commit(put(tableUsers, ID, user))
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordLoginFailureForgetsOldFailures(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+
+			for want := 1; want <= 3; want++ {
+				user, err = db.RecordLoginFailure(user.ID, time.Now().Add(-time.Hour))
+				if err != nil {
+					t.Fatalf("RecordLoginFailure: %s", err)
+				}
+				if user.FailedLogins != want {
+					t.Errorf("FailedLogins = %d, want %d", user.FailedLogins, want)
+				}
+			}
+
+			// the failures so far are all before forgetBefore
+			user, err = db.RecordLoginFailure(user.ID, time.Now().Add(time.Second))
+			if err != nil {
+				t.Fatalf("RecordLoginFailure: %s", err)
+			}
+			if user.FailedLogins != 1 {
+				t.Errorf("FailedLogins after forgetting = %d, want 1", user.FailedLogins)
+			}
+			if user.LastFailedLoginAt == nil {
+				t.Error("LastFailedLoginAt isn't set")
+			}
+		})
+	}
+}
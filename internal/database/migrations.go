@@ -0,0 +1,272 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// migration upgrades a DBStructure from version-1 to version.
+// Migrations run in order on load and must never be edited or
+// reordered once released, only appended to.
+type migration struct {
+	version     int
+	description string
+	up          func(s *DBStructure) error
+}
+
+var migrations = []migration{
+	{
+		version:     1,
+		description: "seed per-table ID sequences",
+		up:          migrateSequences,
+	},
+	{
+		version:     2,
+		description: "backfill created_at and updated_at on chirps and users",
+		up:          migrateTimestamps,
+	},
+	{
+		version:     3,
+		description: "move refresh tokens into per-login sessions",
+		up:          migrateSessions,
+	},
+	{
+		version:     4,
+		description: "hash refresh tokens at rest",
+		up:          migrateTokenHashes,
+	},
+	{
+		version:     5,
+		description: "give existing users the user role",
+		up:          migrateRoles,
+	},
+	{
+		version:     6,
+		description: "turn Chirpy Red flags into subscriptions",
+		up:          migrateSubscriptions,
+	},
+	{
+		version:     7,
+		description: "move processed webhooks into the webhook inbox",
+		up:          migrateWebhookEvents,
+	},
+}
+
+// Migration is a schema migration that ran when a store was opened
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// latestSchemaVersion is the version this binary writes
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate backs up the pre-migration state and runs every pending
+// migration, reporting whether anything ran
+func (db *DB) migrate(s *DBStructure) (bool, error) {
+	latest := latestSchemaVersion()
+	if s.SchemaVersion == latest {
+		return false, nil
+	}
+	if s.SchemaVersion > latest {
+		return false, fmt.Errorf(
+			"database schema version %d is newer than the supported version %d",
+			s.SchemaVersion, latest,
+		)
+	}
+
+	err := db.backup(*s)
+	if err != nil {
+		return false, fmt.Errorf("backing up before migrating: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= s.SchemaVersion {
+			continue
+		}
+
+		err = m.up(s)
+		if err != nil {
+			return false, fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		s.SchemaVersion = m.version
+		db.migrations = append(db.migrations, Migration{Version: m.version, Description: m.description})
+	}
+
+	return true, nil
+}
+
+// Migrations returns the migrations NewDB ran, oldest first
+func (db *DB) Migrations() []Migration {
+	return db.migrations
+}
+
+// backup writes s next to the database file, named after its schema version
+func (db *DB) backup(s DBStructure) error {
+	file, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", db.path, s.SchemaVersion, time.Now().UTC().Format("20060102T150405Z"))
+	return writeFileAtomic(backupPath, file, 0600)
+}
+
+// migrateSequences seeds the sequences of files written before they
+// existed with the highest ID in use
+func migrateSequences(s *DBStructure) error {
+	if s.Sequences == nil {
+		s.Sequences = make(map[string]int)
+	}
+	for id := range s.Chirps {
+		s.Sequences[tableChirps] = max(s.Sequences[tableChirps], id)
+	}
+	for id := range s.Users {
+		s.Sequences[tableUsers] = max(s.Sequences[tableUsers], id)
+	}
+	return nil
+}
+
+// migrateTimestamps stamps records created before timestamps existed
+// with the time of the migration, the best we know
+func migrateTimestamps(s *DBStructure) error {
+	now := time.Now().UTC()
+
+	for id, chirp := range s.Chirps {
+		if chirp.CreatedAt.IsZero() {
+			chirp.CreatedAt = now
+			chirp.UpdatedAt = now
+			s.Chirps[id] = chirp
+		}
+	}
+	for id, user := range s.Users {
+		if user.CreatedAt.IsZero() {
+			user.CreatedAt = now
+			user.UpdatedAt = now
+			s.Users[id] = user
+		}
+	}
+	return nil
+}
+
+// migrateSessions turns the single refresh token each user had, keyed
+// by user ID, into a session holding that token, keyed by its own ID
+func migrateSessions(s *DBStructure) error {
+	now := time.Now().UTC()
+
+	oldTokens := s.Tokens
+	s.Tokens = make(map[int]Token, len(oldTokens))
+	if s.Sessions == nil {
+		s.Sessions = make(map[int]Session, len(oldTokens))
+	}
+
+	userIDs := make([]int, 0, len(oldTokens))
+	for userID := range oldTokens {
+		userIDs = append(userIDs, userID)
+	}
+	slices.Sort(userIDs)
+
+	for _, userID := range userIDs {
+		token := oldTokens[userID]
+
+		session := Session{
+			ID:         s.nextID(tableSessions),
+			UserID:     token.UserID,
+			CreatedAt:  now,
+			LastUsedAt: now,
+			ExpiresAt:  token.TokenExpirationDate,
+		}
+		s.Sessions[session.ID] = session
+		s.Sequences[tableSessions] = session.ID
+
+		token.ID = s.nextID(tableTokens)
+		token.SessionID = session.ID
+		s.Tokens[token.ID] = token
+		s.Sequences[tableTokens] = token.ID
+	}
+
+	return nil
+}
+
+// migrateTokenHashes replaces plaintext refresh tokens with their hash
+func migrateTokenHashes(s *DBStructure) error {
+	for id, token := range s.Tokens {
+		if token.RefreshToken == "" {
+			continue
+		}
+		token.TokenHash = hashToken(token.RefreshToken)
+		token.RefreshToken = ""
+		s.Tokens[id] = token
+	}
+	return nil
+}
+
+// migrateRoles gives users created before roles existed the default role
+func migrateRoles(s *DBStructure) error {
+	for id, user := range s.Users {
+		if len(user.Roles) == 0 {
+			user.Roles = []string{RoleUser}
+			s.Users[id] = user
+		}
+	}
+	return nil
+}
+
+// migrateSubscriptions gives users upgraded before subscriptions existed
+// an active one. Their period starts now, Polka renews it from there.
+func migrateSubscriptions(s *DBStructure) error {
+	now := time.Now().UTC()
+
+	for id, user := range s.Users {
+		if !user.LegacyChirpyRed {
+			continue
+		}
+		user.Subscription = &Subscription{
+			Plan:             PlanChirpyRed,
+			Status:           SubscriptionActive,
+			CurrentPeriodEnd: now.Add(SubscriptionPeriod),
+		}
+		user.LegacyChirpyRed = false
+		s.Users[id] = user
+	}
+	return nil
+}
+
+// migrateWebhookEvents turns the webhooks remembered as processed into
+// processed events of the inbox. Their payload wasn't kept.
+func migrateWebhookEvents(s *DBStructure) error {
+	if s.WebhookEvents == nil {
+		s.WebhookEvents = make(map[int]WebhookEvent, len(s.ProcessedWebhooks))
+	}
+
+	ids := make([]int, 0, len(s.ProcessedWebhooks))
+	for id := range s.ProcessedWebhooks {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+
+	for _, id := range ids {
+		webhook := s.ProcessedWebhooks[id]
+		processedAt := webhook.ProcessedAt
+
+		webhookEvent := WebhookEvent{
+			ID:          s.nextID(tableWebhookEvents),
+			Source:      WebhookSourcePolka,
+			DeliveryID:  webhook.WebhookID,
+			Event:       webhook.Event,
+			Status:      WebhookProcessed,
+			Attempts:    1,
+			ReceivedAt:  processedAt,
+			ProcessedAt: &processedAt,
+		}
+		s.WebhookEvents[webhookEvent.ID] = webhookEvent
+		s.Sequences[tableWebhookEvents] = webhookEvent.ID
+	}
+
+	s.ProcessedWebhooks = nil
+	return nil
+}
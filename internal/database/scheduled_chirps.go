@@ -0,0 +1,109 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// ScheduledChirp is a chirp that becomes a Chirp at PublishAt
+type ScheduledChirp struct {
+	PublishAt time.Time `json:"publish_at"`
+	CreatedAt time.Time `json:"created_at"`
+	Body      string    `json:"body,omitempty"`
+	ID        int       `json:"id,omitempty"`
+	AuthorID  int       `json:"author_id,omitempty"`
+}
+
+// ScheduleChirp saves a chirp to publish at publishAt
+func (db *DB) ScheduleChirp(body string, userID int, publishAt time.Time) (ScheduledChirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	scheduled := ScheduledChirp{
+		ID:        db.data.nextID(tableScheduledChirps),
+		Body:      body,
+		AuthorID:  userID,
+		PublishAt: publishAt.UTC(),
+		CreatedAt: time.Now().UTC(),
+	}
+
+	err := db.commit(put(tableScheduledChirps, scheduled.ID, scheduled))
+	if err != nil {
+		return ScheduledChirp{}, err
+	}
+
+	return scheduled, nil
+}
+
+// ListScheduledChirps returns the chirps a user scheduled,
+// the next to publish first
+func (db *DB) ListScheduledChirps(userID int) ([]ScheduledChirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	scheduled := []ScheduledChirp{}
+	for _, chirp := range db.data.ScheduledChirps {
+		if chirp.AuthorID == userID {
+			scheduled = append(scheduled, chirp)
+		}
+	}
+
+	slices.SortFunc(scheduled, compareScheduledChirps)
+
+	return scheduled, nil
+}
+
+// CancelScheduledChirp deletes a chirp a user scheduled
+func (db *DB) CancelScheduledChirp(ID, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	scheduled, ok := db.data.ScheduledChirps[ID]
+	if !ok || scheduled.AuthorID != userID {
+		return ErrNotFound
+	}
+
+	return db.commit(del(tableScheduledChirps, ID))
+}
+
+// PublishDueChirps turns the scheduled chirps due by now
+// into chirps, returning them
+func (db *DB) PublishDueChirps(now time.Time) ([]Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	var due []ScheduledChirp
+	for _, scheduled := range db.data.ScheduledChirps {
+		if !scheduled.PublishAt.After(now) {
+			due = append(due, scheduled)
+		}
+	}
+	slices.SortFunc(due, compareScheduledChirps)
+
+	published := []Chirp{}
+	for _, scheduled := range due {
+		// the chirp is as new as the moment it appears
+		chirp := Chirp{
+			ID:        db.data.nextID(tableChirps),
+			Body:      scheduled.Body,
+			AuthorID:  scheduled.AuthorID,
+			CreatedAt: now.UTC(),
+			UpdatedAt: now.UTC(),
+		}
+
+		err := db.commit(put(tableChirps, chirp.ID, chirp), del(tableScheduledChirps, scheduled.ID))
+		if err != nil {
+			return published, err
+		}
+		published = append(published, chirp)
+	}
+
+	return published, nil
+}
+
+func compareScheduledChirps(a, b ScheduledChirp) int {
+	if c := a.PublishAt.Compare(b.PublishAt); c != 0 {
+		return c
+	}
+	return a.ID - b.ID
+}
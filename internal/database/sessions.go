@@ -0,0 +1,226 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"time"
+)
+
+// hashToken is how refresh tokens are stored and looked up. They are
+// 256 random bits, so a plain SHA-256 can't be brute forced back to one
+// and leaking the database doesn't leak working tokens.
+func hashToken(refreshToken string) string {
+	sum := sha256.Sum256([]byte(refreshToken))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateSession starts a new session for a user with its first refresh token
+func (db *DB) CreateSession(userID int, userAgent, ip, refreshToken string, expiresAt time.Time) (Session, Token, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	now := time.Now().UTC()
+	session := Session{
+		ID:         db.data.nextID(tableSessions),
+		UserID:     userID,
+		UserAgent:  userAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  expiresAt,
+	}
+	token := Token{
+		ID:                  db.data.nextID(tableTokens),
+		UserID:              userID,
+		SessionID:           session.ID,
+		TokenHash:           hashToken(refreshToken),
+		TokenExpirationDate: expiresAt,
+	}
+
+	err := db.commit(
+		put(tableSessions, session.ID, session),
+		put(tableTokens, token.ID, token),
+	)
+	if err != nil {
+		return Session{}, Token{}, err
+	}
+
+	return session, token, nil
+}
+
+// GetToken get's a token based on it's value
+func (db *DB) GetToken(refreshToken string) (Token, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	id, ok := db.idx.tokensByHash[hashToken(refreshToken)]
+	if !ok {
+		return Token{}, ErrNotFound
+	}
+
+	return db.data.Tokens[id], nil
+}
+
+// RotateToken exchanges a refresh token for newToken in the same
+// session and extends the session to expiresAt. Presenting a token that
+// was already rotated revokes its whole session and returns the token
+// along with ErrTokenReused.
+func (db *DB) RotateToken(refreshToken, newToken string, expiresAt time.Time) (Token, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	id, ok := db.idx.tokensByHash[hashToken(refreshToken)]
+	if !ok {
+		return Token{}, ErrNotFound
+	}
+	old := db.data.Tokens[id]
+
+	if old.RotatedAt != nil {
+		err := db.commit(db.sessionDeletes(func(s Session) bool { return s.ID == old.SessionID })...)
+		if err != nil {
+			return Token{}, err
+		}
+		return old, ErrTokenReused
+	}
+
+	now := time.Now().UTC()
+	if !old.TokenExpirationDate.After(now) {
+		return Token{}, ErrExpired
+	}
+
+	session, ok := db.data.Sessions[old.SessionID]
+	if !ok {
+		return Token{}, ErrNotFound
+	}
+	session.LastUsedAt = now
+	session.ExpiresAt = expiresAt
+
+	old.RotatedAt = &now
+	token := Token{
+		ID:                  db.data.nextID(tableTokens),
+		UserID:              old.UserID,
+		SessionID:           old.SessionID,
+		TokenHash:           hashToken(newToken),
+		TokenExpirationDate: expiresAt,
+	}
+
+	err := db.commit(
+		put(tableTokens, old.ID, old),
+		put(tableTokens, token.ID, token),
+		put(tableSessions, session.ID, session),
+	)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return token, nil
+}
+
+// ListSessions returns the unexpired sessions of a user, newest first
+func (db *DB) ListSessions(userID int) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range db.data.Sessions {
+		if session.UserID == userID && session.ExpiresAt.After(now) {
+			sessions = append(sessions, session)
+		}
+	}
+
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return b.ID - a.ID
+	})
+
+	return sessions, nil
+}
+
+// RevokeSession ends one session of a user and invalidates its refresh tokens
+func (db *DB) RevokeSession(ID, userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	session, ok := db.data.Sessions[ID]
+	if !ok || session.UserID != userID {
+		return ErrNotFound
+	}
+
+	return db.commit(db.sessionDeletes(func(s Session) bool { return s.ID == ID })...)
+}
+
+// RevokeAllSessions ends every session of a user
+func (db *DB) RevokeAllSessions(userID int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	entries := db.sessionDeletes(func(s Session) bool { return s.UserID == userID })
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return db.commit(entries...)
+}
+
+// RevokeToken revokes the session a given refresh token belongs to
+func (db *DB) RevokeToken(refreshToken string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	id, ok := db.idx.tokensByHash[hashToken(refreshToken)]
+	if !ok {
+		return ErrNotFound
+	}
+
+	sessionID := db.data.Tokens[id].SessionID
+
+	return db.commit(db.sessionDeletes(func(s Session) bool { return s.ID == sessionID })...)
+}
+
+// PurgeExpiredSessions deletes the sessions that expired by now along
+// with their tokens, and the tokens of other sessions that expired by
+// now, rotated ones included. It returns how many records it deleted.
+func (db *DB) PurgeExpiredSessions(now time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	entries := db.sessionDeletes(func(s Session) bool { return !s.ExpiresAt.After(now) })
+	for id, token := range db.data.Tokens {
+		session, ok := db.data.Sessions[token.SessionID]
+		if ok && session.ExpiresAt.After(now) && !token.TokenExpirationDate.After(now) {
+			entries = append(entries, del(tableTokens, id))
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	err := db.commit(entries...)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// sessionDeletes returns the entries deleting the matching sessions
+// and all of their tokens. The caller must hold the lock.
+func (db *DB) sessionDeletes(match func(Session) bool) []walEntry {
+	var entries []walEntry
+	revoked := make(map[int]bool)
+
+	for id, session := range db.data.Sessions {
+		if match(session) {
+			revoked[id] = true
+			entries = append(entries, del(tableSessions, id))
+		}
+	}
+	for id, token := range db.data.Tokens {
+		if revoked[token.SessionID] {
+			entries = append(entries, del(tableTokens, id))
+		}
+	}
+
+	return entries
+}
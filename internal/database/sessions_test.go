@@ -0,0 +1,206 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+
+			now := time.Now()
+			_, _, err = db.CreateSession(user.ID, "old", "127.0.0.1", "expired", now.Add(-time.Minute))
+			if err != nil {
+				t.Fatalf("CreateSession: %s", err)
+			}
+			live, _, err := db.CreateSession(user.ID, "new", "127.0.0.1", "rotated", now.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("CreateSession: %s", err)
+			}
+			_, err = db.RotateToken("rotated", "current", now.Add(3*time.Hour))
+			if err != nil {
+				t.Fatalf("RotateToken: %s", err)
+			}
+
+			// the rotated token expired, its session was extended past it
+			n, err := db.PurgeExpiredSessions(now.Add(2 * time.Hour))
+			if err != nil {
+				t.Fatalf("PurgeExpiredSessions: %s", err)
+			}
+			if n != 3 {
+				t.Errorf("purged %d records, want the expired session, its token and the rotated token", n)
+			}
+
+			for _, refreshToken := range []string{"expired", "rotated"} {
+				_, err = db.GetToken(refreshToken)
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("GetToken(%q): err = %v, want ErrNotFound", refreshToken, err)
+				}
+			}
+			token, err := db.GetToken("current")
+			if err != nil {
+				t.Fatalf("GetToken(current): %s", err)
+			}
+			if token.SessionID != live.ID {
+				t.Errorf("current token is in session %d, want %d", token.SessionID, live.ID)
+			}
+
+			sessions, err := db.ListSessions(user.ID)
+			if err != nil {
+				t.Fatalf("ListSessions: %s", err)
+			}
+			if len(sessions) != 1 || sessions[0].ID != live.ID {
+				t.Errorf("sessions = %+v, want only session %d", sessions, live.ID)
+			}
+
+			n, err = db.PurgeExpiredSessions(now.Add(2 * time.Hour))
+			if err != nil {
+				t.Fatalf("PurgeExpiredSessions: %s", err)
+			}
+			if n != 0 {
+				t.Errorf("purging again deleted %d records, want none", n)
+			}
+		})
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+
+			now := time.Now()
+			session, _, err := db.CreateSession(user.ID, "browser", "127.0.0.1", "first", now.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("CreateSession: %s", err)
+			}
+
+			rotated, err := db.RotateToken("first", "second", now.Add(2*time.Hour))
+			if err != nil {
+				t.Fatalf("RotateToken: %s", err)
+			}
+			if rotated.SessionID != session.ID {
+				t.Errorf("rotated token is in session %d, want %d", rotated.SessionID, session.ID)
+			}
+
+			// the old token is spent, whoever presents it again stole it
+			// or raced the owner, so the whole session goes
+			reused, err := db.RotateToken("first", "stolen", now.Add(2*time.Hour))
+			if !errors.Is(err, ErrTokenReused) {
+				t.Fatalf("RotateToken of a rotated token: err = %v, want ErrTokenReused", err)
+			}
+			if reused.SessionID != session.ID {
+				t.Errorf("reused token is in session %d, want %d", reused.SessionID, session.ID)
+			}
+			for _, refreshToken := range []string{"second", "stolen"} {
+				_, err = db.RotateToken(refreshToken, "next", now.Add(2*time.Hour))
+				if !errors.Is(err, ErrNotFound) {
+					t.Errorf("RotateToken(%q) after the reuse: err = %v, want ErrNotFound", refreshToken, err)
+				}
+			}
+			sessions, err := db.ListSessions(user.ID)
+			if err != nil {
+				t.Fatalf("ListSessions: %s", err)
+			}
+			if len(sessions) != 0 {
+				t.Errorf("sessions after the reuse = %+v, want none", sessions)
+			}
+
+			_, _, err = db.CreateSession(user.ID, "browser", "127.0.0.1", "expired", now.Add(-time.Minute))
+			if err != nil {
+				t.Fatalf("CreateSession: %s", err)
+			}
+			_, err = db.RotateToken("expired", "next", now.Add(time.Hour))
+			if !errors.Is(err, ErrExpired) {
+				t.Errorf("RotateToken of an expired token: err = %v, want ErrExpired", err)
+			}
+
+			_, err = db.RotateToken("missing", "next", now.Add(time.Hour))
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("RotateToken of a missing token: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			user, err := db.CreateUser("a@b.com", "old")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			other, err := db.CreateUser("c@d.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			for _, u := range []User{user, other} {
+				refreshToken := fmt.Sprintf("refresh-%d", u.ID)
+				_, _, err = db.CreateSession(u.ID, "browser", "127.0.0.1", refreshToken, time.Now().Add(time.Hour))
+				if err != nil {
+					t.Fatalf("CreateSession: %s", err)
+				}
+				_, err = db.CreateAccessToken(u.ID, "bot", fmt.Sprintf("pat-%d", u.ID), nil, nil)
+				if err != nil {
+					t.Fatalf("CreateAccessToken: %s", err)
+				}
+			}
+
+			err = db.ResetPassword(user.ID, "old", "new")
+			if err != nil {
+				t.Fatalf("ResetPassword: %s", err)
+			}
+			// a second reset bound to the old hash loses
+			err = db.ResetPassword(user.ID, "old", "newer")
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("ResetPassword from a stale hash: err = %v, want ErrNotFound", err)
+			}
+
+			reset, err := db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserByID: %s", err)
+			}
+			if reset.Password != "new" {
+				t.Errorf("password = %q, want %q", reset.Password, "new")
+			}
+
+			_, err = db.GetToken(fmt.Sprintf("refresh-%d", user.ID))
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetToken of the reset user: err = %v, want ErrNotFound", err)
+			}
+			_, err = db.UseAccessToken(fmt.Sprintf("pat-%d", user.ID))
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("UseAccessToken of the reset user: err = %v, want ErrNotFound", err)
+			}
+
+			// other users keep theirs
+			_, err = db.GetToken(fmt.Sprintf("refresh-%d", other.ID))
+			if err != nil {
+				t.Errorf("GetToken of another user: %s", err)
+			}
+			_, err = db.UseAccessToken(fmt.Sprintf("pat-%d", other.ID))
+			if err != nil {
+				t.Errorf("UseAccessToken of another user: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,435 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDB is a Store backed by a SQLite database file
+type SQLiteDB struct {
+	db   *sql.DB
+	path string
+
+	// migrations are the ones opening the database ran
+	migrations []Migration
+}
+
+var _ Store = (*SQLiteDB)(nil)
+
+// rowScanner is satisfied by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const chirpColumns = `id, body, author_id, created_at, updated_at, deleted_at`
+
+func scanChirp(row rowScanner) (Chirp, error) {
+	var chirp Chirp
+	var deletedAt sql.NullTime
+	err := row.Scan(&chirp.ID, &chirp.Body, &chirp.AuthorID, &chirp.CreatedAt, &chirp.UpdatedAt, &deletedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if deletedAt.Valid {
+		chirp.DeletedAt = &deletedAt.Time
+	}
+	return chirp, nil
+}
+
+const userColumns = `id, email, password, created_at, updated_at, roles,
+	email_verified, totp_secret, totp_enabled, totp_last_step, recovery_codes,
+	failed_logins, last_failed_login_at,
+	subscription_plan, subscription_status, subscription_period_end, subscription_grace_end,
+	subscription_event_at`
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	var roles, recoveryCodes string
+	var lastFailedLoginAt sql.NullTime
+	var sub Subscription
+	var periodEnd, graceEnd, eventAt sql.NullTime
+	err := row.Scan(
+		&user.ID, &user.Email, &user.Password, &user.CreatedAt, &user.UpdatedAt, &roles,
+		&user.EmailVerified, &user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastStep, &recoveryCodes,
+		&user.FailedLogins, &lastFailedLoginAt,
+		&sub.Plan, &sub.Status, &periodEnd, &graceEnd, &eventAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrNotFound
+	}
+	if err != nil {
+		return User{}, sqliteErr(err)
+	}
+
+	// roles and recovery codes are stored as comma separated lists
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if recoveryCodes != "" {
+		user.RecoveryCodes = strings.Split(recoveryCodes, ",")
+	}
+	if lastFailedLoginAt.Valid {
+		user.LastFailedLoginAt = &lastFailedLoginAt.Time
+	}
+	// users who never subscribed have no status
+	if sub.Status != "" {
+		sub.CurrentPeriodEnd = periodEnd.Time
+		if graceEnd.Valid {
+			sub.GracePeriodEnd = &graceEnd.Time
+		}
+		if eventAt.Valid {
+			sub.EventAt = &eventAt.Time
+		}
+		user.Subscription = &sub
+	}
+	return user, nil
+}
+
+// NewSQLiteDB opens the SQLite database at path
+// and migrates the schema to the latest version
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	dsn := "file:" + path +
+		"?_pragma=foreign_keys(1)" +
+		"&_pragma=busy_timeout(5000)" +
+		"&_pragma=journal_mode(WAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteDB{db: db, path: path}
+
+	err = s.migrate()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the underlying connection pool
+func (s *SQLiteDB) Close() error {
+	return s.db.Close()
+}
+
+// CreateChirp creates a new chirp
+func (s *SQLiteDB) CreateChirp(body string, userID int) (Chirp, error) {
+	now := time.Now().UTC()
+	return scanChirp(s.db.QueryRow(
+		`INSERT INTO chirps (body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?)
+		RETURNING `+chirpColumns,
+		body, userID, now, now,
+	))
+}
+
+// GetChirps returns a page of chirps
+func (s *SQLiteDB) GetChirps(q ChirpsQuery) (ChirpsPage, error) {
+	afterID, err := q.afterID()
+	if err != nil {
+		return ChirpsPage{}, err
+	}
+
+	query := `SELECT ` + chirpColumns + ` FROM chirps
+		WHERE deleted_at IS NULL
+		AND (? = 0 OR author_id = ?)
+		AND (? OR created_at >= ?)
+		AND (? OR created_at < ?)`
+	if q.sort() == "desc" {
+		query += ` AND (? = 0 OR id < ?) ORDER BY id DESC`
+	} else {
+		query += ` AND (? = 0 OR id > ?) ORDER BY id`
+	}
+	query += ` LIMIT ?`
+
+	// one extra row tells whether there is a next page
+	limit := -1
+	if q.Limit > 0 {
+		limit = q.Limit + 1
+	}
+
+	rows, err := s.db.Query(query,
+		q.AuthorID, q.AuthorID,
+		q.Since.IsZero(), q.Since.UTC(),
+		q.Until.IsZero(), q.Until.UTC(),
+		afterID, afterID,
+		limit,
+	)
+	if err != nil {
+		return ChirpsPage{}, err
+	}
+	defer rows.Close()
+
+	chirps := []Chirp{}
+	for rows.Next() {
+		chirp, err := scanChirp(rows)
+		if err != nil {
+			return ChirpsPage{}, err
+		}
+		chirps = append(chirps, chirp)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return ChirpsPage{}, err
+	}
+
+	return q.page(chirps), nil
+}
+
+// GetChirpByID returns the chirp of the given ID
+func (s *SQLiteDB) GetChirpByID(ID int) (Chirp, error) {
+	return scanChirp(s.db.QueryRow(
+		`SELECT `+chirpColumns+` FROM chirps WHERE id = ? AND deleted_at IS NULL`,
+		ID,
+	))
+}
+
+// DeleteChirpByID removes the chirp of the given ID
+func (s *SQLiteDB) DeleteChirpByID(ID, userID int) error {
+	_, err := s.ownedChirp(ID, userID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`DELETE FROM chirps WHERE id = ? AND author_id = ?`, ID, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// RemoveChirpByID removes the chirp of the given ID
+// whoever wrote it, for moderation
+func (s *SQLiteDB) RemoveChirpByID(ID int) error {
+	res, err := s.db.Exec(`DELETE FROM chirps WHERE id = ?`, ID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// SoftDeleteChirpByID hides the chirp of the given ID
+// until it is restored with RestoreChirpByID
+func (s *SQLiteDB) SoftDeleteChirpByID(ID, userID int) error {
+	_, err := s.ownedChirp(ID, userID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(
+		`UPDATE chirps SET deleted_at = ? WHERE id = ? AND author_id = ? AND deleted_at IS NULL`,
+		time.Now().UTC(), ID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// RestoreChirpByID brings back a soft deleted chirp
+// if it was deleted less than gracePeriod ago
+func (s *SQLiteDB) RestoreChirpByID(ID, userID int, gracePeriod time.Duration) (Chirp, error) {
+	chirp, err := s.ownedChirp(ID, userID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.DeletedAt == nil {
+		return Chirp{}, ErrNotFound
+	}
+	if time.Since(*chirp.DeletedAt) > gracePeriod {
+		return Chirp{}, ErrExpired
+	}
+
+	return scanChirp(s.db.QueryRow(
+		`UPDATE chirps SET deleted_at = NULL WHERE id = ? AND deleted_at IS NOT NULL
+		RETURNING `+chirpColumns,
+		ID,
+	))
+}
+
+// PurgeDeletedChirps removes the chirps soft deleted before
+// deletedBefore, returning how many it removed
+func (s *SQLiteDB) PurgeDeletedChirps(deletedBefore time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM chirps WHERE deleted_at < ?`, deletedBefore.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// UpdateChirp replaces the body of a chirp of userID
+func (s *SQLiteDB) UpdateChirp(ID, userID int, body string) (Chirp, error) {
+	chirp, err := s.ownedChirp(ID, userID)
+	if err != nil {
+		return Chirp{}, err
+	}
+	if chirp.DeletedAt != nil {
+		return Chirp{}, ErrNotFound
+	}
+
+	return scanChirp(s.db.QueryRow(
+		`UPDATE chirps SET body = ?, updated_at = ? WHERE id = ? AND author_id = ? AND deleted_at IS NULL
+		RETURNING `+chirpColumns,
+		body, time.Now().UTC(), ID, userID,
+	))
+}
+
+// ownedChirp returns the chirp of the given ID, deleted or not,
+// if it belongs to userID
+func (s *SQLiteDB) ownedChirp(ID, userID int) (Chirp, error) {
+	chirp, err := scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, ID))
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	if chirp.AuthorID != userID {
+		return Chirp{}, ErrUnauthorized
+	}
+
+	return chirp, nil
+}
+
+// CreateUser creates a new user
+func (s *SQLiteDB) CreateUser(email string, password string) (User, error) {
+	now := time.Now().UTC()
+	return scanUser(s.db.QueryRow(
+		`INSERT INTO users (email, password, created_at, updated_at) VALUES (?, ?, ?, ?)
+		RETURNING `+userColumns,
+		email, password, now, now,
+	))
+}
+
+// GetUserByID retrieves the user of the given ID
+func (s *SQLiteDB) GetUserByID(ID int) (User, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, ID))
+}
+
+// GetUser retrieves the user for a given email
+func (s *SQLiteDB) GetUser(email string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`SELECT `+userColumns+` FROM users WHERE email = ? COLLATE NOCASE`,
+		email,
+	))
+}
+
+// UpdateUser updates a given user
+func (s *SQLiteDB) UpdateUser(ID int, email, password string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`UPDATE users SET
+			email_verified = email_verified AND email = ? COLLATE NOCASE,
+			email = ?, password = ?, updated_at = ?
+		WHERE id = ?
+		RETURNING `+userColumns,
+		email, email, password, time.Now().UTC(), ID,
+	))
+}
+
+// RehashPassword replaces the password hash of a given user with
+// newHash of the same password, unless it changed from oldHash since
+func (s *SQLiteDB) RehashPassword(ID int, oldHash, newHash string) error {
+	res, err := s.db.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, newHash, ID, oldHash)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// ResetPassword replaces the password hash of a given user with
+// newHash, unless it changed from oldHash since, and revokes their
+// sessions and access tokens in the same transaction. Of two resets
+// with the same token only the first one gets through.
+func (s *SQLiteDB) ResetPassword(ID int, oldHash, newHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		`UPDATE users SET password = ?, updated_at = ? WHERE id = ? AND password = ?`,
+		newHash, time.Now().UTC(), ID, oldHash,
+	)
+	if err != nil {
+		return err
+	}
+	err = expectAffected(res)
+	if err != nil {
+		return err
+	}
+
+	// deleting the sessions cascades to their tokens
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, ID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM access_tokens WHERE user_id = ?`, ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// MarkEmailVerified records that a given user owns their email
+func (s *SQLiteDB) MarkEmailVerified(ID int) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns,
+		time.Now().UTC(), ID,
+	))
+}
+
+// SetUserRoles replaces the roles of a given user
+func (s *SQLiteDB) SetUserRoles(ID int, roles []string) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`UPDATE users SET roles = ?, updated_at = ? WHERE id = ?
+		RETURNING `+userColumns,
+		strings.Join(roles, ","), time.Now().UTC(), ID,
+	))
+}
+
+// notFound maps sql.ErrNoRows to ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// expectAffected returns ErrNotFound when a statement touched no rows
+func expectAffected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// sqliteErr maps driver errors onto the package errors
+func sqliteErr(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE {
+		return ErrAlreadyExists
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+const accessTokenColumns = `id, user_id, name, token_hash, scopes, created_at, last_used_at, expires_at`
+
+func scanAccessToken(row rowScanner) (AccessToken, error) {
+	var accessToken AccessToken
+	var scopes string
+	var lastUsedAt, expiresAt sql.NullTime
+	err := row.Scan(
+		&accessToken.ID, &accessToken.UserID, &accessToken.Name, &accessToken.TokenHash,
+		&scopes, &accessToken.CreatedAt, &lastUsedAt, &expiresAt,
+	)
+	if err != nil {
+		return AccessToken{}, notFound(err)
+	}
+
+	// scopes are stored as a comma separated list
+	accessToken.Scopes = []string{}
+	if scopes != "" {
+		accessToken.Scopes = strings.Split(scopes, ",")
+	}
+	if lastUsedAt.Valid {
+		accessToken.LastUsedAt = &lastUsedAt.Time
+	}
+	if expiresAt.Valid {
+		accessToken.ExpiresAt = &expiresAt.Time
+	}
+	return accessToken, nil
+}
+
+// CreateAccessToken stores a new personal access token for a user
+func (s *SQLiteDB) CreateAccessToken(userID int, name, token string, scopes []string, expiresAt *time.Time) (AccessToken, error) {
+	var expires sql.NullTime
+	if expiresAt != nil {
+		expires = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+
+	return scanAccessToken(s.db.QueryRow(
+		`INSERT INTO access_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING `+accessTokenColumns,
+		userID, name, hashToken(token), strings.Join(scopes, ","), time.Now().UTC(), expires,
+	))
+}
+
+// UseAccessToken returns the unexpired access token matching token
+// and records that it was used
+func (s *SQLiteDB) UseAccessToken(token string) (AccessToken, error) {
+	accessToken, err := scanAccessToken(s.db.QueryRow(
+		`SELECT `+accessTokenColumns+` FROM access_tokens WHERE token_hash = ?`,
+		hashToken(token),
+	))
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	now := time.Now().UTC()
+	if accessToken.expired(now) {
+		return AccessToken{}, ErrExpired
+	}
+
+	if accessToken.LastUsedAt != nil && now.Sub(*accessToken.LastUsedAt) < accessTokenTouchInterval {
+		return accessToken, nil
+	}
+
+	_, err = s.db.Exec(`UPDATE access_tokens SET last_used_at = ? WHERE id = ?`, now, accessToken.ID)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	accessToken.LastUsedAt = &now
+
+	return accessToken, nil
+}
+
+// ListAccessTokens returns the access tokens of a user, newest first
+func (s *SQLiteDB) ListAccessTokens(userID int) ([]AccessToken, error) {
+	rows, err := s.db.Query(
+		`SELECT `+accessTokenColumns+` FROM access_tokens WHERE user_id = ? ORDER BY id DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accessTokens := []AccessToken{}
+	for rows.Next() {
+		accessToken, err := scanAccessToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		accessTokens = append(accessTokens, accessToken)
+	}
+
+	return accessTokens, rows.Err()
+}
+
+// RevokeAccessToken deletes an access token of a user
+func (s *SQLiteDB) RevokeAccessToken(ID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM access_tokens WHERE id = ? AND user_id = ?`, ID, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
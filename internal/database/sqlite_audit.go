@@ -0,0 +1,20 @@
+package database
+
+import "time"
+
+// RecordAuditEvent appends an event to the audit trail
+func (s *SQLiteDB) RecordAuditEvent(event AuditEvent) (AuditEvent, error) {
+	event.CreatedAt = time.Now().UTC()
+
+	err := s.db.QueryRow(
+		`INSERT INTO audit_events (type, user_id, session_id, ip, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING id`,
+		event.Type, event.UserID, event.SessionID, event.IP, event.UserAgent, event.CreatedAt,
+	).Scan(&event.ID)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+
+	return event, nil
+}
@@ -0,0 +1,34 @@
+package database
+
+import (
+	"time"
+)
+
+// RecordLoginFailure counts a failed login of a given user, returning
+// the user with the updated count. When the last failure was before
+// forgetBefore, the count starts over.
+func (s *SQLiteDB) RecordLoginFailure(ID int, forgetBefore time.Time) (User, error) {
+	return scanUser(s.db.QueryRow(
+		`UPDATE users SET
+			failed_logins = CASE WHEN last_failed_login_at IS NULL OR last_failed_login_at < ? THEN 1
+				ELSE failed_logins + 1 END,
+			last_failed_login_at = ?
+		WHERE id = ?
+		RETURNING `+userColumns,
+		forgetBefore.UTC(), time.Now().UTC(), ID,
+	))
+}
+
+// ResetLoginFailures forgets the failed logins of a given user,
+// lifting any lockout
+func (s *SQLiteDB) ResetLoginFailures(ID int) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET failed_logins = 0, last_failed_login_at = NULL WHERE id = ?`,
+		ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
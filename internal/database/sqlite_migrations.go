@@ -0,0 +1,442 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// sqliteMigration upgrades the schema from version-1 to version,
+// tracked in PRAGMA user_version. Like the JSON migrations they are
+// append only.
+type sqliteMigration struct {
+	version     int
+	description string
+	up          func(tx *sql.Tx) error
+}
+
+var sqliteMigrations = []sqliteMigration{
+	{
+		version:     1,
+		description: "create users, chirps and tokens",
+		up: execMigration(`
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL UNIQUE,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	body      TEXT    NOT NULL,
+	author_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE INDEX IF NOT EXISTS chirps_author_id_idx ON chirps (author_id, id);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	user_id               INTEGER   PRIMARY KEY REFERENCES users (id),
+	refresh_token         TEXT      NOT NULL UNIQUE,
+	token_expiration_date TIMESTAMP NOT NULL
+);
+`),
+	},
+	{
+		version:     2,
+		description: "add chirps.deleted_at for soft deletes",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "chirps", "deleted_at", "TIMESTAMP")
+		},
+	},
+	{
+		version:     3,
+		description: "make user emails unique regardless of case",
+		up: execMigration(`
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_nocase_idx ON users (email COLLATE NOCASE);
+`),
+	},
+	{
+		version:     4,
+		description: "add created_at and updated_at to chirps and users",
+		up:          migrateSQLiteTimestamps,
+	},
+	{
+		version:     5,
+		description: "move refresh tokens into per-login sessions",
+		up: execMigration(`
+CREATE TABLE sessions (
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	user_agent   TEXT      NOT NULL DEFAULT '',
+	ip           TEXT      NOT NULL DEFAULT '',
+	created_at   TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP NOT NULL,
+	expires_at   TIMESTAMP NOT NULL
+);
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+INSERT INTO sessions (user_id, created_at, last_used_at, expires_at)
+SELECT user_id, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, token_expiration_date FROM tokens ORDER BY user_id;
+
+CREATE TABLE session_tokens (
+	id                    INTEGER   PRIMARY KEY AUTOINCREMENT,
+	session_id            INTEGER   NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	user_id               INTEGER   NOT NULL REFERENCES users (id),
+	refresh_token         TEXT      NOT NULL UNIQUE,
+	token_expiration_date TIMESTAMP NOT NULL
+);
+
+CREATE INDEX session_tokens_session_id_idx ON session_tokens (session_id);
+
+INSERT INTO session_tokens (session_id, user_id, refresh_token, token_expiration_date)
+SELECT s.id, t.user_id, t.refresh_token, t.token_expiration_date
+FROM tokens t JOIN sessions s ON s.user_id = t.user_id;
+
+DROP TABLE tokens;
+ALTER TABLE session_tokens RENAME TO tokens;
+`),
+	},
+	{
+		version:     6,
+		description: "track rotated refresh tokens and add the audit trail",
+		up: execMigration(`
+ALTER TABLE tokens ADD COLUMN rotated_at TIMESTAMP;
+
+CREATE TABLE audit_events (
+	id         INTEGER   PRIMARY KEY AUTOINCREMENT,
+	type       TEXT      NOT NULL,
+	user_id    INTEGER   NOT NULL DEFAULT 0,
+	session_id INTEGER   NOT NULL DEFAULT 0,
+	ip         TEXT      NOT NULL DEFAULT '',
+	user_agent TEXT      NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX audit_events_user_id_idx ON audit_events (user_id, id);
+`),
+	},
+	{
+		version:     7,
+		description: "hash refresh tokens at rest",
+		up:          migrateSQLiteTokenHashes,
+	},
+	{
+		version:     8,
+		description: "give users roles, user by default",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "users", "roles", "TEXT NOT NULL DEFAULT '"+RoleUser+"'")
+		},
+	},
+	{
+		version:     9,
+		description: "create personal access tokens",
+		up: execMigration(`
+CREATE TABLE access_tokens (
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name         TEXT      NOT NULL,
+	token_hash   TEXT      NOT NULL UNIQUE,
+	scopes       TEXT      NOT NULL DEFAULT '',
+	created_at   TIMESTAMP NOT NULL,
+	last_used_at TIMESTAMP,
+	expires_at   TIMESTAMP
+);
+
+CREATE INDEX access_tokens_user_id_idx ON access_tokens (user_id);
+`),
+	},
+	{
+		version:     10,
+		description: "add TOTP two-factor authentication to users",
+		up: execMigration(`
+ALTER TABLE users ADD COLUMN totp_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN totp_enabled INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN recovery_codes TEXT NOT NULL DEFAULT '';
+`),
+	},
+	{
+		version:     11,
+		description: "track verified emails",
+		up: func(tx *sql.Tx) error {
+			return addColumnIfMissing(tx, "users", "email_verified", "INTEGER NOT NULL DEFAULT 0")
+		},
+	},
+	{
+		version:     12,
+		description: "count failed logins for lockouts",
+		up: execMigration(`
+ALTER TABLE users ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN last_failed_login_at TIMESTAMP;
+`),
+	},
+	{
+		version:     13,
+		description: "remember processed webhooks",
+		up: execMigration(`
+CREATE TABLE processed_webhooks (
+	id           INTEGER   PRIMARY KEY AUTOINCREMENT,
+	webhook_id   TEXT      NOT NULL UNIQUE,
+	event        TEXT      NOT NULL,
+	processed_at TIMESTAMP NOT NULL
+);
+`),
+	},
+	{
+		version:     14,
+		description: "turn Chirpy Red flags into subscriptions",
+		up:          migrateSQLiteSubscriptions,
+	},
+	{
+		version:     15,
+		description: "create scheduled chirps",
+		up: execMigration(`
+CREATE TABLE scheduled_chirps (
+	id         INTEGER   PRIMARY KEY AUTOINCREMENT,
+	body       TEXT      NOT NULL,
+	author_id  INTEGER   NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	publish_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX scheduled_chirps_publish_at_idx ON scheduled_chirps (publish_at);
+CREATE INDEX scheduled_chirps_author_id_idx ON scheduled_chirps (author_id);
+`),
+	},
+	{
+		version:     16,
+		description: "move processed webhooks into the webhook inbox",
+		up:          migrateSQLiteWebhookEvents,
+	},
+	{
+		version:     17,
+		description: "remember when the last event applied to a subscription happened",
+		up: execMigration(`
+ALTER TABLE users ADD COLUMN subscription_event_at TIMESTAMP;
+`),
+	},
+}
+
+// migrate backs up the database file and runs every pending migration,
+// each in its own transaction
+func (s *SQLiteDB) migrate() error {
+	var version int
+	err := s.db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	latest := sqliteMigrations[len(sqliteMigrations)-1].version
+	if version == latest {
+		return nil
+	}
+	if version > latest {
+		return fmt.Errorf(
+			"database schema version %d is newer than the supported version %d",
+			version, latest,
+		)
+	}
+
+	err = s.backup(version)
+	if err != nil {
+		return fmt.Errorf("backing up before migrating: %w", err)
+	}
+
+	for _, m := range sqliteMigrations {
+		if m.version <= version {
+			continue
+		}
+
+		err = s.runMigration(m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+		s.migrations = append(s.migrations, Migration{Version: m.version, Description: m.description})
+	}
+
+	return nil
+}
+
+// Migrations returns the migrations NewSQLiteDB ran, oldest first
+func (s *SQLiteDB) Migrations() []Migration {
+	return s.migrations
+}
+
+func (s *SQLiteDB) runMigration(m sqliteMigration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = m.up(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, m.version))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// backup copies a database that already has tables
+// next to the database file, named after its schema version
+func (s *SQLiteDB) backup(version int) error {
+	var tables int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'`).Scan(&tables)
+	if err != nil || tables == 0 {
+		return err
+	}
+
+	backupPath := fmt.Sprintf("%s.v%d-%s.bak", s.path, version, time.Now().UTC().Format("20060102T150405Z"))
+	_, err = s.db.Exec(`VACUUM INTO ?`, backupPath)
+	return err
+}
+
+// migrateSQLiteTimestamps stamps existing rows with the time
+// of the migration, the best we know
+func migrateSQLiteTimestamps(tx *sql.Tx) error {
+	now := time.Now().UTC()
+
+	for _, table := range []string{"chirps", "users"} {
+		for _, column := range []string{"created_at", "updated_at"} {
+			err := addColumnIfMissing(tx, table, column, "TIMESTAMP")
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(`UPDATE `+table+` SET created_at = ?, updated_at = ? WHERE created_at IS NULL`, now, now)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := tx.Exec(`CREATE INDEX IF NOT EXISTS chirps_created_at_idx ON chirps (created_at)`)
+	return err
+}
+
+// migrateSQLiteTokenHashes replaces plaintext refresh tokens with their hash
+func migrateSQLiteTokenHashes(tx *sql.Tx) error {
+	rows, err := tx.Query(`SELECT id, refresh_token FROM tokens`)
+	if err != nil {
+		return err
+	}
+
+	hashes := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var refreshToken string
+		err = rows.Scan(&id, &refreshToken)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		hashes[id] = hashToken(refreshToken)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	for id, hash := range hashes {
+		_, err = tx.Exec(`UPDATE tokens SET refresh_token = ? WHERE id = ?`, hash, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`ALTER TABLE tokens RENAME COLUMN refresh_token TO token_hash`)
+	return err
+}
+
+// migrateSQLiteSubscriptions gives users upgraded before subscriptions
+// existed an active one. Their period starts now, Polka renews it from there.
+func migrateSQLiteSubscriptions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE users ADD COLUMN subscription_plan TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN subscription_status TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN subscription_period_end TIMESTAMP;
+ALTER TABLE users ADD COLUMN subscription_grace_end TIMESTAMP;
+`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`UPDATE users SET subscription_plan = ?, subscription_status = ?, subscription_period_end = ?
+		WHERE is_chirpy_red = 1`,
+		PlanChirpyRed, SubscriptionActive, time.Now().UTC().Add(SubscriptionPeriod),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`ALTER TABLE users DROP COLUMN is_chirpy_red`)
+	return err
+}
+
+// migrateSQLiteWebhookEvents creates the webhook inbox and turns the
+// webhooks remembered as processed into processed events of it. Their
+// payload wasn't kept.
+func migrateSQLiteWebhookEvents(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE webhook_events (
+	id              INTEGER   PRIMARY KEY AUTOINCREMENT,
+	source          TEXT      NOT NULL,
+	delivery_id     TEXT      NOT NULL DEFAULT '',
+	event           TEXT      NOT NULL DEFAULT '',
+	payload         TEXT      NOT NULL DEFAULT '',
+	status          TEXT      NOT NULL,
+	attempts        INTEGER   NOT NULL DEFAULT 0,
+	last_error      TEXT      NOT NULL DEFAULT '',
+	received_at     TIMESTAMP NOT NULL,
+	next_attempt_at TIMESTAMP,
+	processed_at    TIMESTAMP
+);
+
+CREATE UNIQUE INDEX webhook_events_delivery_idx ON webhook_events (source, delivery_id) WHERE delivery_id != '';
+CREATE INDEX webhook_events_due_idx ON webhook_events (status, next_attempt_at);
+`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO webhook_events (source, delivery_id, event, status, attempts, received_at, processed_at)
+		SELECT ?, webhook_id, event, ?, 1, processed_at, processed_at FROM processed_webhooks ORDER BY id`,
+		WebhookSourcePolka, WebhookProcessed,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DROP TABLE processed_webhooks`)
+	return err
+}
+
+func execMigration(query string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(query)
+		return err
+	}
+}
+
+// addColumnIfMissing adds a column to a table created before it existed
+func addColumnIfMissing(tx *sql.Tx, table, column, decl string) error {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, table, column).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+
+	_, err = tx.Exec(strings.Join([]string{"ALTER TABLE", table, "ADD COLUMN", column, decl}, " "))
+	return err
+}
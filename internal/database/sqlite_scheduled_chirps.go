@@ -0,0 +1,120 @@
+package database
+
+import (
+	"time"
+)
+
+const scheduledChirpColumns = `id, body, author_id, publish_at, created_at`
+
+func scanScheduledChirp(row rowScanner) (ScheduledChirp, error) {
+	var scheduled ScheduledChirp
+	err := row.Scan(&scheduled.ID, &scheduled.Body, &scheduled.AuthorID, &scheduled.PublishAt, &scheduled.CreatedAt)
+	if err != nil {
+		return ScheduledChirp{}, notFound(err)
+	}
+	return scheduled, nil
+}
+
+// ScheduleChirp saves a chirp to publish at publishAt
+func (s *SQLiteDB) ScheduleChirp(body string, userID int, publishAt time.Time) (ScheduledChirp, error) {
+	return scanScheduledChirp(s.db.QueryRow(
+		`INSERT INTO scheduled_chirps (body, author_id, publish_at, created_at) VALUES (?, ?, ?, ?)
+		RETURNING `+scheduledChirpColumns,
+		body, userID, publishAt.UTC(), time.Now().UTC(),
+	))
+}
+
+// ListScheduledChirps returns the chirps a user scheduled,
+// the next to publish first
+func (s *SQLiteDB) ListScheduledChirps(userID int) ([]ScheduledChirp, error) {
+	rows, err := s.db.Query(
+		`SELECT `+scheduledChirpColumns+` FROM scheduled_chirps WHERE author_id = ? ORDER BY publish_at, id`,
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	scheduled := []ScheduledChirp{}
+	for rows.Next() {
+		chirp, err := scanScheduledChirp(rows)
+		if err != nil {
+			return nil, err
+		}
+		scheduled = append(scheduled, chirp)
+	}
+
+	return scheduled, rows.Err()
+}
+
+// CancelScheduledChirp deletes a chirp a user scheduled
+func (s *SQLiteDB) CancelScheduledChirp(ID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM scheduled_chirps WHERE id = ? AND author_id = ?`, ID, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// PublishDueChirps turns the scheduled chirps due by now
+// into chirps, returning them
+func (s *SQLiteDB) PublishDueChirps(now time.Time) ([]Chirp, error) {
+	now = now.UTC()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`SELECT `+scheduledChirpColumns+` FROM scheduled_chirps WHERE publish_at <= ? ORDER BY publish_at, id`,
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var due []ScheduledChirp
+	for rows.Next() {
+		scheduled, err := scanScheduledChirp(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, scheduled)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	published := []Chirp{}
+	for _, scheduled := range due {
+		// the chirp is as new as the moment it appears
+		chirp, err := scanChirp(tx.QueryRow(
+			`INSERT INTO chirps (body, author_id, created_at, updated_at) VALUES (?, ?, ?, ?)
+			RETURNING `+chirpColumns,
+			scheduled.Body, scheduled.AuthorID, now, now,
+		))
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(`DELETE FROM scheduled_chirps WHERE id = ?`, scheduled.ID)
+		if err != nil {
+			return nil, err
+		}
+		published = append(published, chirp)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return published, nil
+}
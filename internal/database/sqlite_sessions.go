@@ -0,0 +1,233 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+const sessionColumns = `id, user_id, user_agent, ip, created_at, last_used_at, expires_at`
+
+func scanSession(row rowScanner) (Session, error) {
+	var session Session
+	err := row.Scan(
+		&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+		&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt,
+	)
+	if err != nil {
+		return Session{}, notFound(err)
+	}
+
+	return session, nil
+}
+
+const tokenColumns = `id, session_id, user_id, token_hash, token_expiration_date, rotated_at`
+
+func scanToken(row rowScanner) (Token, error) {
+	var token Token
+	var rotatedAt sql.NullTime
+	err := row.Scan(&token.ID, &token.SessionID, &token.UserID, &token.TokenHash, &token.TokenExpirationDate, &rotatedAt)
+	if err != nil {
+		return Token{}, notFound(err)
+	}
+
+	if rotatedAt.Valid {
+		token.RotatedAt = &rotatedAt.Time
+	}
+	return token, nil
+}
+
+// CreateSession starts a new session for a user with its first refresh token
+func (s *SQLiteDB) CreateSession(userID int, userAgent, ip, refreshToken string, expiresAt time.Time) (Session, Token, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Session{}, Token{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	session, err := scanSession(tx.QueryRow(
+		`INSERT INTO sessions (user_id, user_agent, ip, created_at, last_used_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		RETURNING `+sessionColumns,
+		userID, userAgent, ip, now, now, expiresAt.UTC(),
+	))
+	if err != nil {
+		return Session{}, Token{}, err
+	}
+
+	token, err := scanToken(tx.QueryRow(
+		`INSERT INTO tokens (session_id, user_id, token_hash, token_expiration_date)
+		VALUES (?, ?, ?, ?)
+		RETURNING `+tokenColumns,
+		session.ID, userID, hashToken(refreshToken), expiresAt.UTC(),
+	))
+	if err != nil {
+		return Session{}, Token{}, err
+	}
+
+	return session, token, tx.Commit()
+}
+
+// GetToken get's a token based on it's value
+func (s *SQLiteDB) GetToken(refreshToken string) (Token, error) {
+	return scanToken(s.db.QueryRow(
+		`SELECT `+tokenColumns+` FROM tokens WHERE token_hash = ?`,
+		hashToken(refreshToken),
+	))
+}
+
+// RotateToken exchanges a refresh token for newToken in the same
+// session and extends the session to expiresAt. Presenting a token that
+// was already rotated revokes its whole session and returns the token
+// along with ErrTokenReused.
+func (s *SQLiteDB) RotateToken(refreshToken, newToken string, expiresAt time.Time) (Token, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Token{}, err
+	}
+	defer tx.Rollback()
+
+	old, err := scanToken(tx.QueryRow(
+		`SELECT `+tokenColumns+` FROM tokens WHERE token_hash = ?`,
+		hashToken(refreshToken),
+	))
+	if err != nil {
+		return Token{}, err
+	}
+
+	if old.RotatedAt != nil {
+		_, err = tx.Exec(`DELETE FROM sessions WHERE id = ?`, old.SessionID)
+		if err != nil {
+			return Token{}, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return Token{}, err
+		}
+		return old, ErrTokenReused
+	}
+
+	now := time.Now().UTC()
+	if !old.TokenExpirationDate.After(now) {
+		return Token{}, ErrExpired
+	}
+
+	res, err := tx.Exec(`UPDATE tokens SET rotated_at = ? WHERE id = ? AND rotated_at IS NULL`, now, old.ID)
+	if err != nil {
+		return Token{}, err
+	}
+	err = expectAffected(res)
+	if err != nil {
+		return Token{}, err
+	}
+
+	res, err = tx.Exec(
+		`UPDATE sessions SET last_used_at = ?, expires_at = ? WHERE id = ?`,
+		now, expiresAt.UTC(), old.SessionID,
+	)
+	if err != nil {
+		return Token{}, err
+	}
+	err = expectAffected(res)
+	if err != nil {
+		return Token{}, err
+	}
+
+	token, err := scanToken(tx.QueryRow(
+		`INSERT INTO tokens (session_id, user_id, token_hash, token_expiration_date)
+		VALUES (?, ?, ?, ?)
+		RETURNING `+tokenColumns,
+		old.SessionID, old.UserID, hashToken(newToken), expiresAt.UTC(),
+	))
+	if err != nil {
+		return Token{}, err
+	}
+
+	return token, tx.Commit()
+}
+
+// ListSessions returns the unexpired sessions of a user, newest first
+func (s *SQLiteDB) ListSessions(userID int) ([]Session, error) {
+	rows, err := s.db.Query(
+		`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND expires_at > ? ORDER BY id DESC`,
+		userID, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends one session of a user and invalidates its refresh tokens
+func (s *SQLiteDB) RevokeSession(ID, userID int) error {
+	res, err := s.db.Exec(`DELETE FROM sessions WHERE id = ? AND user_id = ?`, ID, userID)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// RevokeAllSessions ends every session of a user
+func (s *SQLiteDB) RevokeAllSessions(userID int) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE user_id = ?`, userID)
+	return err
+}
+
+// RevokeToken revokes the session a given refresh token belongs to
+func (s *SQLiteDB) RevokeToken(refreshToken string) error {
+	res, err := s.db.Exec(
+		`DELETE FROM sessions WHERE id = (SELECT session_id FROM tokens WHERE token_hash = ?)`,
+		hashToken(refreshToken),
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// PurgeExpiredSessions deletes the sessions that expired by now along
+// with their tokens, and the tokens of other sessions that expired by
+// now, rotated ones included. It returns how many records it deleted.
+func (s *SQLiteDB) PurgeExpiredSessions(now time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// the tokens of expired sessions go first, to be counted,
+	// deleting the sessions would cascade to them anyway
+	tokens, err := tx.Exec(`DELETE FROM tokens WHERE token_expiration_date <= ?
+		OR session_id IN (SELECT id FROM sessions WHERE expires_at <= ?)`, now.UTC(), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	sessions, err := tx.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	tokensPurged, err := tokens.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	sessionsPurged, err := sessions.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(tokensPurged + sessionsPurged), tx.Commit()
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// UpdateSubscription applies change to the subscription of a given
+// user, a zero one if they never had any, and commits it unless
+// change fails
+func (s *SQLiteDB) UpdateSubscription(userID int, change func(sub *Subscription) error) (User, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	user, err := updateSubscription(tx, userID, change)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// updateSubscription applies change to the subscription of a given
+// user within tx, unless change fails
+func updateSubscription(tx *sql.Tx, userID int, change func(sub *Subscription) error) (User, error) {
+	user, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, userID))
+	if err != nil {
+		return User{}, err
+	}
+
+	var sub Subscription
+	if user.Subscription != nil {
+		sub = *user.Subscription
+	}
+
+	err = change(&sub)
+	if err != nil {
+		return User{}, err
+	}
+
+	var graceEnd, eventAt sql.NullTime
+	if sub.GracePeriodEnd != nil {
+		graceEnd = sql.NullTime{Time: sub.GracePeriodEnd.UTC(), Valid: true}
+	}
+	if sub.EventAt != nil {
+		eventAt = sql.NullTime{Time: sub.EventAt.UTC(), Valid: true}
+	}
+
+	return scanUser(tx.QueryRow(
+		`UPDATE users SET
+			subscription_plan = ?, subscription_status = ?,
+			subscription_period_end = ?, subscription_grace_end = ?,
+			subscription_event_at = ?, updated_at = ?
+		WHERE id = ?
+		RETURNING `+userColumns,
+		sub.Plan, sub.Status, sub.CurrentPeriodEnd.UTC(), graceEnd, eventAt, time.Now().UTC(), userID,
+	))
+}
+
+// ExpireSubscriptions marks the subscriptions that lapsed by now
+// as expired, returning how many did
+func (s *SQLiteDB) ExpireSubscriptions(now time.Time) (int, error) {
+	now = now.UTC()
+	res, err := s.db.Exec(
+		`UPDATE users SET subscription_status = ?, updated_at = ?
+		WHERE (subscription_status IN (?, ?) AND subscription_period_end <= ?)
+		OR (subscription_status = ? AND (subscription_grace_end IS NULL OR subscription_grace_end <= ?))`,
+		SubscriptionExpired, now,
+		SubscriptionActive, SubscriptionCancelled, now,
+		SubscriptionPastDue, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
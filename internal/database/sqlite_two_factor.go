@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// SetTOTPSecret starts a TOTP enrollment, replacing any
+// unconfirmed one. It fails for users that already have 2FA on.
+func (s *SQLiteDB) SetTOTPSecret(userID int, secret string) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return ErrAlreadyExists
+	}
+
+	res, err := s.db.Exec(
+		`UPDATE users SET totp_secret = ?, updated_at = ? WHERE id = ? AND totp_enabled = 0`,
+		secret, time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// EnableTOTP turns on 2FA once the user proved they have the secret
+// with a code of time step, storing the hashes of their recovery codes
+func (s *SQLiteDB) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	user, err := s.GetUserByID(userID)
+	if err != nil {
+		return err
+	}
+	if user.TOTPEnabled {
+		return ErrAlreadyExists
+	}
+
+	res, err := s.db.Exec(
+		`UPDATE users SET totp_enabled = 1, totp_last_step = ?, recovery_codes = ?, updated_at = ?
+		WHERE id = ? AND totp_enabled = 0 AND totp_secret != ''`,
+		step, strings.Join(recoveryCodes, ","), time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
+
+// UseTOTPStep records that a code of time step was accepted,
+// returning ErrTokenReused if that step or a later one already was
+func (s *SQLiteDB) UseTOTPStep(userID int, step int64) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET totp_last_step = ?, updated_at = ? WHERE id = ? AND totp_last_step < ?`,
+		step, time.Now().UTC(), userID, step,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = expectAffected(res)
+	if errors.Is(err, ErrNotFound) {
+		_, err = s.GetUserByID(userID)
+		if err == nil {
+			return ErrTokenReused
+		}
+	}
+	return err
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash
+func (s *SQLiteDB) UseRecoveryCode(userID int, codeHash string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var codes string
+	err = tx.QueryRow(`SELECT recovery_codes FROM users WHERE id = ?`, userID).Scan(&codes)
+	if err != nil {
+		return notFound(err)
+	}
+
+	recoveryCodes := strings.Split(codes, ",")
+	i := slices.Index(recoveryCodes, codeHash)
+	if codes == "" || i < 0 {
+		return ErrNotFound
+	}
+	recoveryCodes = slices.Delete(recoveryCodes, i, i+1)
+
+	_, err = tx.Exec(
+		`UPDATE users SET recovery_codes = ?, updated_at = ? WHERE id = ?`,
+		strings.Join(recoveryCodes, ","), time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DisableTOTP turns off 2FA and forgets the secret and recovery codes
+func (s *SQLiteDB) DisableTOTP(userID int) error {
+	res, err := s.db.Exec(
+		`UPDATE users SET totp_secret = '', totp_enabled = 0, totp_last_step = 0, recovery_codes = '', updated_at = ?
+		WHERE id = ?`,
+		time.Now().UTC(), userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(res)
+}
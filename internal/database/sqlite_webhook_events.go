@@ -0,0 +1,212 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const webhookEventColumns = `id, source, delivery_id, event, payload, status, attempts, last_error,
+	received_at, next_attempt_at, processed_at`
+
+func scanWebhookEvent(row rowScanner) (WebhookEvent, error) {
+	var webhookEvent WebhookEvent
+	var nextAttemptAt, processedAt sql.NullTime
+	err := row.Scan(
+		&webhookEvent.ID, &webhookEvent.Source, &webhookEvent.DeliveryID, &webhookEvent.Event,
+		&webhookEvent.Payload, &webhookEvent.Status, &webhookEvent.Attempts, &webhookEvent.LastError,
+		&webhookEvent.ReceivedAt, &nextAttemptAt, &processedAt,
+	)
+	if err != nil {
+		return WebhookEvent{}, sqliteErr(notFound(err))
+	}
+
+	if nextAttemptAt.Valid {
+		webhookEvent.NextAttemptAt = &nextAttemptAt.Time
+	}
+	if processedAt.Valid {
+		webhookEvent.ProcessedAt = &processedAt.Time
+	}
+	return webhookEvent, nil
+}
+
+// ReceiveWebhookEvent saves a delivery as pending, claimed until
+// claimUntil by the caller. It returns ErrAlreadyExists if a delivery
+// of the same ID was received before.
+func (s *SQLiteDB) ReceiveWebhookEvent(source, deliveryID, event, payload string, claimUntil time.Time) (WebhookEvent, error) {
+	return scanWebhookEvent(s.db.QueryRow(
+		`INSERT INTO webhook_events (source, delivery_id, event, payload, status, received_at, next_attempt_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		RETURNING `+webhookEventColumns,
+		source, deliveryID, event, payload, WebhookPending, time.Now().UTC(), claimUntil.UTC(),
+	))
+}
+
+// GetWebhookEvent returns the webhook event of the given ID
+func (s *SQLiteDB) GetWebhookEvent(ID int) (WebhookEvent, error) {
+	return scanWebhookEvent(s.db.QueryRow(`SELECT `+webhookEventColumns+` FROM webhook_events WHERE id = ?`, ID))
+}
+
+// ListWebhookEvents returns the latest limit webhook events, newest
+// first, only those of status when it's set
+func (s *SQLiteDB) ListWebhookEvents(status string, limit int) ([]WebhookEvent, error) {
+	// a negative LIMIT is no limit in SQLite
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.db.Query(
+		`SELECT `+webhookEventColumns+` FROM webhook_events WHERE ? = '' OR status = ? ORDER BY id DESC LIMIT ?`,
+		status, status, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectWebhookEvents(rows)
+}
+
+// ClaimDueWebhookEvents returns up to limit pending webhook events due
+// by now, oldest due first, claiming them until claimUntil
+func (s *SQLiteDB) ClaimDueWebhookEvents(now, claimUntil time.Time, limit int) ([]WebhookEvent, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	rows, err := s.db.Query(
+		`UPDATE webhook_events SET next_attempt_at = ?
+		WHERE id IN (
+			SELECT id FROM webhook_events WHERE status = ? AND next_attempt_at <= ?
+			ORDER BY next_attempt_at, id LIMIT ?
+		)
+		RETURNING `+webhookEventColumns,
+		claimUntil.UTC(), WebhookPending, now.UTC(), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return collectWebhookEvents(rows)
+}
+
+// ClaimWebhookEvent makes the webhook event of the given ID pending
+// again, claimed until claimUntil. It returns ErrWebhookProcessed for
+// processed events and ErrWebhookClaimed for pending ones whose claim
+// hasn't run out by now.
+func (s *SQLiteDB) ClaimWebhookEvent(ID int, now, claimUntil time.Time) (WebhookEvent, error) {
+	webhookEvent, err := scanWebhookEvent(s.db.QueryRow(
+		`UPDATE webhook_events SET status = ?, next_attempt_at = ?
+		WHERE id = ? AND status != ?
+		AND NOT (status = ? AND next_attempt_at IS NOT NULL AND next_attempt_at > ?)
+		RETURNING `+webhookEventColumns,
+		WebhookPending, claimUntil.UTC(), ID, WebhookProcessed, WebhookPending, now.UTC(),
+	))
+	if errors.Is(err, ErrNotFound) {
+		return WebhookEvent{}, webhookEventConflict(s.GetWebhookEvent(ID))
+	}
+	return webhookEvent, err
+}
+
+// ApplyWebhookEvent applies change to the subscription of a given user
+// and records the webhook event of the given ID as processed at now, in
+// the same transaction, so an event is never applied without the record
+// of it. It returns ErrWebhookProcessed if the event already was.
+func (s *SQLiteDB) ApplyWebhookEvent(ID, userID int, change func(sub *Subscription) error, now time.Time) (WebhookEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	defer tx.Rollback()
+
+	webhookEvent, err := scanWebhookEvent(tx.QueryRow(
+		`UPDATE webhook_events
+		SET attempts = attempts + 1, status = ?, last_error = '', next_attempt_at = NULL, processed_at = ?
+		WHERE id = ? AND status != ?
+		RETURNING `+webhookEventColumns,
+		WebhookProcessed, now.UTC(), ID, WebhookProcessed,
+	))
+	if errors.Is(err, ErrNotFound) {
+		return WebhookEvent{}, webhookEventConflict(scanWebhookEvent(
+			tx.QueryRow(`SELECT `+webhookEventColumns+` FROM webhook_events WHERE id = ?`, ID),
+		))
+	}
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	_, err = updateSubscription(tx, userID, change)
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhookEvent, nil
+}
+
+// RecordWebhookAttempt records the outcome of processing the webhook
+// event of the given ID at now. Pending events are retried at
+// nextAttemptAt, processed and ignored ones are done.
+func (s *SQLiteDB) RecordWebhookAttempt(ID int, status, lastError string, nextAttemptAt *time.Time, now time.Time) (WebhookEvent, error) {
+	var next, processedAt sql.NullTime
+	if nextAttemptAt != nil {
+		next = sql.NullTime{Time: nextAttemptAt.UTC(), Valid: true}
+	}
+	if status == WebhookProcessed || status == WebhookIgnored {
+		processedAt = sql.NullTime{Time: now.UTC(), Valid: true}
+	}
+
+	return scanWebhookEvent(s.db.QueryRow(
+		`UPDATE webhook_events
+		SET attempts = attempts + 1, status = ?, last_error = ?, next_attempt_at = ?, processed_at = ?
+		WHERE id = ?
+		RETURNING `+webhookEventColumns,
+		status, lastError, next, processedAt, ID,
+	))
+}
+
+// PurgeWebhookEvents deletes the webhook events received before
+// receivedBefore that are done with, processed, ignored or failed,
+// returning how many it deleted. Pending ones are kept until they are.
+func (s *SQLiteDB) PurgeWebhookEvents(receivedBefore time.Time) (int, error) {
+	res, err := s.db.Exec(
+		`DELETE FROM webhook_events WHERE status != ? AND received_at < ?`,
+		WebhookPending, receivedBefore.UTC(),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// webhookEventConflict tells why a webhook event wasn't updated: it's
+// gone, already processed, or claimed by someone else
+func webhookEventConflict(webhookEvent WebhookEvent, err error) error {
+	if err != nil {
+		return err
+	}
+	if webhookEvent.Status == WebhookProcessed {
+		return ErrWebhookProcessed
+	}
+	return ErrWebhookClaimed
+}
+
+func collectWebhookEvents(rows *sql.Rows) ([]WebhookEvent, error) {
+	defer rows.Close()
+
+	webhookEvents := []WebhookEvent{}
+	for rows.Next() {
+		webhookEvent, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhookEvents = append(webhookEvents, webhookEvent)
+	}
+
+	return webhookEvents, rows.Err()
+}
@@ -0,0 +1,112 @@
+package database
+
+import (
+	"io"
+	"time"
+)
+
+// ChirpStore persists chirps
+type ChirpStore interface {
+	CreateChirp(body string, userID int) (Chirp, error)
+	GetChirps(q ChirpsQuery) (ChirpsPage, error)
+	GetChirpByID(ID int) (Chirp, error)
+	DeleteChirpByID(ID, userID int) error
+	RemoveChirpByID(ID int) error
+	SoftDeleteChirpByID(ID, userID int) error
+	RestoreChirpByID(ID, userID int, gracePeriod time.Duration) (Chirp, error)
+	PurgeDeletedChirps(deletedBefore time.Time) (int, error)
+	UpdateChirp(ID, userID int, body string) (Chirp, error)
+}
+
+// ScheduledChirpStore persists chirps waiting to be published
+type ScheduledChirpStore interface {
+	ScheduleChirp(body string, userID int, publishAt time.Time) (ScheduledChirp, error)
+	ListScheduledChirps(userID int) ([]ScheduledChirp, error)
+	CancelScheduledChirp(ID, userID int) error
+	PublishDueChirps(now time.Time) ([]Chirp, error)
+}
+
+// UserStore persists users
+type UserStore interface {
+	CreateUser(email string, password string) (User, error)
+	GetUser(email string) (User, error)
+	GetUserByID(ID int) (User, error)
+	UpdateUser(ID int, email, password string) (User, error)
+	RehashPassword(ID int, oldHash, newHash string) error
+	ResetPassword(ID int, oldHash, newHash string) error
+	SetUserRoles(ID int, roles []string) (User, error)
+	MarkEmailVerified(ID int) (User, error)
+	RecordLoginFailure(ID int, forgetBefore time.Time) (User, error)
+	ResetLoginFailures(ID int) error
+}
+
+// SubscriptionStore persists the Chirpy Red subscriptions of users
+type SubscriptionStore interface {
+	UpdateSubscription(userID int, change func(sub *Subscription) error) (User, error)
+	ExpireSubscriptions(now time.Time) (int, error)
+}
+
+// TwoFactorStore persists the TOTP enrollment of users
+type TwoFactorStore interface {
+	SetTOTPSecret(userID int, secret string) error
+	EnableTOTP(userID int, step int64, recoveryCodes []string) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, codeHash string) error
+	DisableTOTP(userID int) error
+}
+
+// SessionStore persists login sessions and their refresh tokens
+type SessionStore interface {
+	CreateSession(userID int, userAgent, ip, refreshToken string, expiresAt time.Time) (Session, Token, error)
+	GetToken(refreshToken string) (Token, error)
+	RotateToken(refreshToken, newToken string, expiresAt time.Time) (Token, error)
+	ListSessions(userID int) ([]Session, error)
+	RevokeSession(ID, userID int) error
+	RevokeAllSessions(userID int) error
+	RevokeToken(refreshToken string) error
+	PurgeExpiredSessions(now time.Time) (int, error)
+}
+
+// AccessTokenStore persists personal access tokens
+type AccessTokenStore interface {
+	CreateAccessToken(userID int, name, token string, scopes []string, expiresAt *time.Time) (AccessToken, error)
+	UseAccessToken(token string) (AccessToken, error)
+	ListAccessTokens(userID int) ([]AccessToken, error)
+	RevokeAccessToken(ID, userID int) error
+}
+
+// AuditStore keeps a trail of security relevant events
+type AuditStore interface {
+	RecordAuditEvent(event AuditEvent) (AuditEvent, error)
+}
+
+// WebhookStore is the inbox of inbound webhooks
+type WebhookStore interface {
+	ReceiveWebhookEvent(source, deliveryID, event, payload string, claimUntil time.Time) (WebhookEvent, error)
+	GetWebhookEvent(ID int) (WebhookEvent, error)
+	ListWebhookEvents(status string, limit int) ([]WebhookEvent, error)
+	ClaimDueWebhookEvents(now, claimUntil time.Time, limit int) ([]WebhookEvent, error)
+	ClaimWebhookEvent(ID int, now, claimUntil time.Time) (WebhookEvent, error)
+	ApplyWebhookEvent(ID, userID int, change func(sub *Subscription) error, now time.Time) (WebhookEvent, error)
+	RecordWebhookAttempt(ID int, status, lastError string, nextAttemptAt *time.Time, now time.Time) (WebhookEvent, error)
+	PurgeWebhookEvents(receivedBefore time.Time) (int, error)
+}
+
+// Store is everything the API needs from a storage backend
+type Store interface {
+	ChirpStore
+	ScheduledChirpStore
+	UserStore
+	SubscriptionStore
+	TwoFactorStore
+	SessionStore
+	AccessTokenStore
+	AuditStore
+	WebhookStore
+	io.Closer
+
+	// Migrations returns the schema migrations opening the store ran
+	Migrations() []Migration
+}
+
+var _ Store = (*DB)(nil)
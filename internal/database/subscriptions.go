@@ -0,0 +1,124 @@
+package database
+
+import "time"
+
+// PlanChirpyRed is the only plan there is for now
+const PlanChirpyRed = "chirpy_red"
+
+// SubscriptionPeriod is how long a period lasts when Polka doesn't say
+const SubscriptionPeriod = 30 * 24 * time.Hour
+
+// Subscription statuses
+const (
+	// SubscriptionActive is paid until CurrentPeriodEnd
+	SubscriptionActive = "active"
+	// SubscriptionPastDue failed to renew, it's kept until GracePeriodEnd
+	SubscriptionPastDue = "past_due"
+	// SubscriptionCancelled won't renew, it's kept until CurrentPeriodEnd
+	SubscriptionCancelled = "cancelled"
+	// SubscriptionExpired is over
+	SubscriptionExpired = "expired"
+)
+
+// Subscription is a user's subscription to a paid plan
+type Subscription struct {
+	CurrentPeriodEnd time.Time  `json:"current_period_end"`
+	GracePeriodEnd   *time.Time `json:"grace_period_end,omitempty"`
+	// EventAt is when the last event applied to it happened, events
+	// that happened before are stale
+	EventAt *time.Time `json:"event_at,omitempty"`
+	Plan    string     `json:"plan"`
+	Status  string     `json:"status"`
+}
+
+// Active reports whether the subscription gives access to its plan at now
+func (s Subscription) Active(now time.Time) bool {
+	switch s.Status {
+	case SubscriptionActive, SubscriptionCancelled:
+		return now.Before(s.CurrentPeriodEnd)
+	case SubscriptionPastDue:
+		return s.GracePeriodEnd != nil && now.Before(*s.GracePeriodEnd)
+	default:
+		return false
+	}
+}
+
+// IsChirpyRed reports whether the user currently has Chirpy Red
+func (u User) IsChirpyRed() bool {
+	return u.Subscription != nil && u.Subscription.Plan == PlanChirpyRed && u.Subscription.Active(time.Now())
+}
+
+// UpdateSubscription applies change to the subscription of a given
+// user, a zero one if they never had any, and commits it unless
+// change fails
+func (db *DB) UpdateSubscription(userID int, change func(sub *Subscription) error) (User, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, err := db.changeSubscription(userID, change)
+	if err != nil {
+		return User{}, err
+	}
+
+	err = db.commit(put(tableUsers, userID, user))
+	if err != nil {
+		return User{}, err
+	}
+
+	return user, nil
+}
+
+// changeSubscription returns the user of the given ID with change
+// applied to their subscription, without committing it. The caller must
+// hold the write lock.
+func (db *DB) changeSubscription(userID int, change func(sub *Subscription) error) (User, error) {
+	user, exists := db.data.Users[userID]
+	if !exists {
+		return User{}, ErrNotFound
+	}
+
+	var sub Subscription
+	if user.Subscription != nil {
+		sub = *user.Subscription
+	}
+
+	err := change(&sub)
+	if err != nil {
+		return User{}, err
+	}
+	user.Subscription = &sub
+	user.UpdatedAt = time.Now().UTC()
+
+	return user, nil
+}
+
+// ExpireSubscriptions marks the subscriptions that lapsed by now
+// as expired, returning how many did
+func (db *DB) ExpireSubscriptions(now time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	var entries []walEntry
+	for id, user := range db.data.Users {
+		sub := user.Subscription
+		if sub == nil || sub.Status == SubscriptionExpired || sub.Active(now) {
+			continue
+		}
+
+		expired := *sub
+		expired.Status = SubscriptionExpired
+		user.Subscription = &expired
+		user.UpdatedAt = now.UTC()
+		entries = append(entries, put(tableUsers, id, user))
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	err := db.commit(entries...)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestExpireSubscriptions(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			now := time.Now().UTC()
+			periodEnd := now.Add(-time.Hour)
+			graceEnd := now.Add(time.Hour)
+			subs := map[string]*Subscription{
+				"active":            {Plan: PlanChirpyRed, Status: SubscriptionActive, CurrentPeriodEnd: now.Add(2 * time.Hour)},
+				"active lapsed":     {Plan: PlanChirpyRed, Status: SubscriptionActive, CurrentPeriodEnd: periodEnd},
+				"past due in grace": {Plan: PlanChirpyRed, Status: SubscriptionPastDue, CurrentPeriodEnd: periodEnd, GracePeriodEnd: &graceEnd},
+				"cancelled lapsed":  {Plan: PlanChirpyRed, Status: SubscriptionCancelled, CurrentPeriodEnd: periodEnd},
+				"none":              nil,
+			}
+			users := map[string]int{}
+			for desc, sub := range subs {
+				user, err := db.CreateUser(fmt.Sprintf("user%d@b.com", len(users)), "hash")
+				if err != nil {
+					t.Fatalf("CreateUser: %s", err)
+				}
+				users[desc] = user.ID
+				if sub == nil {
+					continue
+				}
+				_, err = db.UpdateSubscription(user.ID, func(s *Subscription) error {
+					*s = *sub
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("UpdateSubscription: %s", err)
+				}
+			}
+
+			statuses := func() map[string]string {
+				got := map[string]string{}
+				for desc, id := range users {
+					user, err := db.GetUserByID(id)
+					if err != nil {
+						t.Fatalf("GetUserByID: %s", err)
+					}
+					if user.Subscription != nil {
+						got[desc] = user.Subscription.Status
+					}
+				}
+				return got
+			}
+			check := func(when string, want map[string]string) {
+				got := statuses()
+				for desc, status := range want {
+					if got[desc] != status {
+						t.Errorf("%s: status of %s = %q, want %q", when, desc, got[desc], status)
+					}
+				}
+				if _, ok := got["none"]; ok {
+					t.Errorf("%s: a user without a subscription got one", when)
+				}
+			}
+
+			n, err := db.ExpireSubscriptions(now)
+			if err != nil {
+				t.Fatalf("ExpireSubscriptions: %s", err)
+			}
+			if n != 2 {
+				t.Errorf("expired %d subscriptions, want 2", n)
+			}
+			check("now", map[string]string{
+				"active":            SubscriptionActive,
+				"active lapsed":     SubscriptionExpired,
+				"past due in grace": SubscriptionPastDue,
+				"cancelled lapsed":  SubscriptionExpired,
+			})
+
+			// once the grace period is over too
+			n, err = db.ExpireSubscriptions(graceEnd)
+			if err != nil {
+				t.Fatalf("ExpireSubscriptions: %s", err)
+			}
+			if n != 1 {
+				t.Errorf("expired %d subscriptions after the grace period, want 1", n)
+			}
+			check("after the grace period", map[string]string{
+				"active":            SubscriptionActive,
+				"past due in grace": SubscriptionExpired,
+			})
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"slices"
+	"time"
+)
+
+// SetTOTPSecret starts a TOTP enrollment, replacing any
+// unconfirmed one. It fails for users that already have 2FA on.
+func (db *DB) SetTOTPSecret(userID int, secret string) error {
+	return db.updateUser(userID, func(user *User) error {
+		if user.TOTPEnabled {
+			return ErrAlreadyExists
+		}
+		user.TOTPSecret = secret
+		return nil
+	})
+}
+
+// EnableTOTP turns on 2FA once the user proved they have the secret
+// with a code of time step, storing the hashes of their recovery codes
+func (db *DB) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	return db.updateUser(userID, func(user *User) error {
+		if user.TOTPSecret == "" {
+			return ErrNotFound
+		}
+		if user.TOTPEnabled {
+			return ErrAlreadyExists
+		}
+		user.TOTPEnabled = true
+		user.TOTPLastStep = step
+		user.RecoveryCodes = recoveryCodes
+		return nil
+	})
+}
+
+// UseTOTPStep records that a code of time step was accepted,
+// returning ErrTokenReused if that step or a later one already was
+func (db *DB) UseTOTPStep(userID int, step int64) error {
+	return db.updateUser(userID, func(user *User) error {
+		if step <= user.TOTPLastStep {
+			return ErrTokenReused
+		}
+		user.TOTPLastStep = step
+		return nil
+	})
+}
+
+// UseRecoveryCode consumes the recovery code with the given hash
+func (db *DB) UseRecoveryCode(userID int, codeHash string) error {
+	return db.updateUser(userID, func(user *User) error {
+		i := slices.Index(user.RecoveryCodes, codeHash)
+		if i < 0 {
+			return ErrNotFound
+		}
+		user.RecoveryCodes = slices.Delete(slices.Clone(user.RecoveryCodes), i, i+1)
+		return nil
+	})
+}
+
+// DisableTOTP turns off 2FA and forgets the secret and recovery codes
+func (db *DB) DisableTOTP(userID int) error {
+	return db.updateUser(userID, func(user *User) error {
+		user.TOTPSecret = ""
+		user.TOTPEnabled = false
+		user.TOTPLastStep = 0
+		user.RecoveryCodes = nil
+		return nil
+	})
+}
+
+// updateUser applies change to a user and commits it, unless change fails
+func (db *DB) updateUser(ID int, change func(user *User) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, exists := db.data.Users[ID]
+	if !exists {
+		return ErrNotFound
+	}
+
+	err := change(&user)
+	if err != nil {
+		return err
+	}
+	user.UpdatedAt = time.Now().UTC()
+
+	return db.commit(put(tableUsers, ID, user))
+}
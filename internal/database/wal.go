@@ -0,0 +1,372 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The write-ahead log sits next to the database file and holds one JSON
+// record per committed mutation. A record is appended and fsynced before
+// the mutation is applied in memory, and the log is truncated once a
+// snapshot containing it is safely on disk, so whatever is in the log on
+// startup is replayed.
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+
+	tableChirps   = "chirps"
+	tableUsers    = "users"
+	tableTokens   = "tokens"
+	tableSessions = "sessions"
+	tableAudit    = "audit_events"
+
+	tableAccessTokens  = "access_tokens"
+	tableWebhookEvents = "webhook_events"
+
+	tableScheduledChirps = "scheduled_chirps"
+
+	// tableProcessedWebhooks is only written by binaries before the
+	// webhook inbox, its entries can still be in their log
+	tableProcessedWebhooks = "processed_webhooks"
+)
+
+// afterSnapshot runs once a snapshot is on disk, before the log is
+// truncated. Tests make it fail to simulate a crash at that point.
+var afterSnapshot = func() error { return nil }
+
+// walEntry is a single change to one of the DBStructure tables
+type walEntry struct {
+	Op    string `json:"op"`
+	Table string `json:"table"`
+	ID    int    `json:"id"`
+	Value any    `json:"value,omitempty"`
+}
+
+// walRecord groups the entries of one commit so they're replayed all or nothing
+type walRecord struct {
+	Entries []walEntry `json:"entries"`
+}
+
+func put(table string, id int, value any) walEntry {
+	return walEntry{Op: opPut, Table: table, ID: id, Value: value}
+}
+
+func del(table string, id int) walEntry {
+	return walEntry{Op: opDelete, Table: table, ID: id}
+}
+
+// UnmarshalJSON keeps the value raw until we know which table it belongs to
+func (e *walEntry) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Op    string          `json:"op"`
+		Table string          `json:"table"`
+		ID    int             `json:"id"`
+		Value json.RawMessage `json:"value,omitempty"`
+	}
+	err := json.Unmarshal(data, &aux)
+	if err != nil {
+		return err
+	}
+
+	*e = walEntry{Op: aux.Op, Table: aux.Table, ID: aux.ID, Value: aux.Value}
+	return nil
+}
+
+// apply applies a single entry to the structure
+func (s *DBStructure) apply(e walEntry) error {
+	if e.Op == opPut {
+		// sequences only move forward, which also restores them on replay
+		if s.Sequences == nil {
+			s.Sequences = make(map[string]int)
+		}
+		s.Sequences[e.Table] = max(s.Sequences[e.Table], e.ID)
+	}
+
+	switch e.Table {
+	case tableChirps:
+		return applyTo(&s.Chirps, e)
+	case tableUsers:
+		return applyTo(&s.Users, e)
+	case tableTokens:
+		return applyTo(&s.Tokens, e)
+	case tableSessions:
+		return applyTo(&s.Sessions, e)
+	case tableAudit:
+		return applyTo(&s.AuditEvents, e)
+	case tableAccessTokens:
+		return applyTo(&s.AccessTokens, e)
+	case tableWebhookEvents:
+		return applyTo(&s.WebhookEvents, e)
+	case tableScheduledChirps:
+		return applyTo(&s.ScheduledChirps, e)
+	case tableProcessedWebhooks:
+		return applyTo(&s.ProcessedWebhooks, e)
+	default:
+		return fmt.Errorf("unknown table %q in log", e.Table)
+	}
+}
+
+func applyTo[V any](m *map[int]V, e walEntry) error {
+	if *m == nil {
+		*m = make(map[int]V)
+	}
+
+	switch e.Op {
+	case opDelete:
+		delete(*m, e.ID)
+		return nil
+	case opPut:
+		v, ok := e.Value.(V)
+		if !ok {
+			raw, isRaw := e.Value.(json.RawMessage)
+			if !isRaw {
+				return fmt.Errorf("unexpected value %T for table %q", e.Value, e.Table)
+			}
+			err := json.Unmarshal(raw, &v)
+			if err != nil {
+				return err
+			}
+		}
+		(*m)[e.ID] = v
+		return nil
+	default:
+		return fmt.Errorf("unknown op %q in log", e.Op)
+	}
+}
+
+// commit durably records the entries and applies them to the
+// in-memory database. The caller must hold the write lock.
+func (db *DB) commit(entries ...walEntry) error {
+	err := db.commitToLog(entries...)
+	if err != nil {
+		return err
+	}
+
+	if db.policy.Mode == FlushEveryWrite {
+		// the mutation is already committed to the log, a failed
+		// snapshot is retried on the next flush or replayed on startup
+		err = db.flush()
+		if err != nil {
+			db.logFlushError(err)
+		}
+	}
+	return nil
+}
+
+// commitToLog is commit without the snapshot FlushEveryWrite asks for,
+// for bookkeeping that isn't worth rewriting the whole file. It's as
+// durable, the log keeps it until the next flush.
+func (db *DB) commitToLog(entries ...walEntry) error {
+	err := db.appendLog(walRecord{Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err = db.apply(e)
+		if err != nil {
+			return err
+		}
+	}
+	db.dirty = true
+	return nil
+}
+
+func (db *DB) logPath() string {
+	return db.path + ".wal"
+}
+
+// appendLog appends a record to the log and waits for it to hit the disk
+func (db *DB) appendLog(record walRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f, err := os.OpenFile(db.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(line)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// replayLog applies every complete record in the log to dbStructure
+// and returns how many records were replayed. A torn last line means the
+// process died while appending, before that mutation was acknowledged,
+// so it is dropped. A corrupt line anywhere else is an error.
+func (db *DB) replayLog(dbStructure *DBStructure) (int, error) {
+	file, err := os.ReadFile(db.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	reader := bufio.NewReader(bytes.NewReader(file))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// no trailing newline, the last append never completed
+			break
+		}
+		if err != nil {
+			return replayed, err
+		}
+
+		var record walRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			if _, peekErr := reader.Peek(1); errors.Is(peekErr, io.EOF) {
+				// the last line, which may have been torn all the same
+				break
+			}
+			// acknowledged records follow, dropping them silently
+			// would lose writes
+			return replayed, fmt.Errorf("corrupt record %d in %s: %w", replayed+1, db.logPath(), err)
+		}
+
+		for _, e := range record.Entries {
+			err = dbStructure.apply(e)
+			if err != nil {
+				return replayed, err
+			}
+		}
+		replayed++
+	}
+
+	return replayed, nil
+}
+
+// truncateLog empties the log once its records are part of the snapshot
+func (db *DB) truncateLog() error {
+	err := os.Truncate(db.logPath(), 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// load reads the snapshot into memory, replays the log on top of it,
+// recovering whatever a crash or an unflushed shutdown left behind,
+// and brings the result up to the current schema version
+func (db *DB) load() error {
+	removeTempFiles(db.path)
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		return err
+	}
+
+	replayed, err := db.replayLog(&dbStructure)
+	if err != nil {
+		return err
+	}
+
+	// the log was written at the snapshot's schema version, so it's
+	// folded into a snapshot of that version before migrating. Otherwise
+	// a crash between writing the migrated snapshot and truncating the
+	// log would replay old records over migrated data.
+	if replayed > 0 && dbStructure.SchemaVersion < latestSchemaVersion() {
+		err = db.writeDB(dbStructure)
+		if err == nil {
+			err = afterSnapshot()
+		}
+		if err != nil {
+			return err
+		}
+		err = db.truncateLog()
+		if err != nil {
+			return err
+		}
+	}
+
+	migrated, err := db.migrate(&dbStructure)
+	if err != nil {
+		return err
+	}
+
+	db.data = dbStructure
+	db.rebuildIndexes()
+
+	if replayed == 0 && !migrated {
+		return db.truncateLog()
+	}
+
+	db.dirty = true
+	return db.flush()
+}
+
+// writeFileAtomic writes data to a temp file in the same directory,
+// fsyncs it and renames it over path, so readers only ever see the old
+// or the new content
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(perm)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// syncDir makes a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// removeTempFiles removes temp files left behind by an interrupted write
+func removeTempFiles(path string) {
+	matches, err := filepath.Glob(path + ".tmp-*")
+	if err != nil {
+		return
+	}
+	for _, m := range matches {
+		os.Remove(m)
+	}
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var errCrash = errors.New("simulated crash")
+
+func openTestDB(t *testing.T, path string, mode FlushMode) *DB {
+	t.Helper()
+
+	db, err := NewDB(path, FlushPolicy{Mode: mode})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	return db
+}
+
+// crashAfterSnapshot makes flushes fail once the snapshot is on disk,
+// before the log is truncated, whenever crash says so
+func crashAfterSnapshot(t *testing.T, crash func() bool) {
+	t.Helper()
+
+	afterSnapshot = func() error {
+		if crash() {
+			return errCrash
+		}
+		return nil
+	}
+	t.Cleanup(func() { afterSnapshot = func() error { return nil } })
+}
+
+func TestReplayRecoversUnflushedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := openTestDB(t, path, FlushOnClose)
+	chirp, err := db.CreateChirp("hello", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %s", err)
+	}
+	// no Close, the process died with the chirp only in the log
+
+	db = openTestDB(t, path, FlushOnClose)
+	got, err := db.GetChirpByID(chirp.ID)
+	if err != nil {
+		t.Fatalf("GetChirpByID after replay: %s", err)
+	}
+	if got.Body != "hello" {
+		t.Errorf("body = %q, want %q", got.Body, "hello")
+	}
+}
+
+func TestReplayDropsTornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := openTestDB(t, path, FlushOnClose)
+	first, err := db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	_, err = db.CreateUser("c@d.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+
+	// the process died halfway through appending the second record
+	log, err := os.ReadFile(db.logPath())
+	if err != nil {
+		t.Fatalf("reading log: %s", err)
+	}
+	err = os.WriteFile(db.logPath(), log[:len(log)-10], 0644)
+	if err != nil {
+		t.Fatalf("tearing log: %s", err)
+	}
+
+	db = openTestDB(t, path, FlushOnClose)
+	_, err = db.GetUser("a@b.com")
+	if err != nil {
+		t.Errorf("GetUser of the complete record: %s", err)
+	}
+	_, err = db.GetUser("c@d.com")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetUser of the torn record: err = %v, want ErrNotFound", err)
+	}
+
+	user, err := db.CreateUser("e@f.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser after replay: %s", err)
+	}
+	if user.ID != first.ID+1 {
+		t.Errorf("ID after torn record = %d, want %d", user.ID, first.ID+1)
+	}
+}
+
+func TestReplayRejectsCorruptionMidLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := openTestDB(t, path, FlushOnClose)
+	for _, email := range []string{"a@b.com", "c@d.com", "e@f.com"} {
+		_, err := db.CreateUser(email, "hash")
+		if err != nil {
+			t.Fatalf("CreateUser: %s", err)
+		}
+	}
+
+	// the second record is damaged, the third was acknowledged after it
+	log, err := os.ReadFile(db.logPath())
+	if err != nil {
+		t.Fatalf("reading log: %s", err)
+	}
+	lines := bytes.SplitAfter(log, []byte("\n"))
+	lines[1] = append([]byte("{garbage"), lines[1][len("{garbage"):]...)
+	err = os.WriteFile(db.logPath(), bytes.Join(lines, nil), 0644)
+	if err != nil {
+		t.Fatalf("corrupting log: %s", err)
+	}
+
+	_, err = NewDB(path, FlushPolicy{Mode: FlushOnClose})
+	if err == nil {
+		t.Fatal("NewDB replayed a log corrupt before its last line")
+	}
+}
+
+func TestLoadIgnoresLeftoverTempFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := openTestDB(t, path, FlushEveryWrite)
+	_, err := db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	// the process died writing the next snapshot, before the rename
+	tmpPath := path + ".tmp-123456"
+	err = os.WriteFile(tmpPath, []byte(`{"schema_version":7,"users":{"1":{"id":`), 0644)
+	if err != nil {
+		t.Fatalf("writing temp file: %s", err)
+	}
+
+	db = openTestDB(t, path, FlushEveryWrite)
+	_, err = db.GetUser("a@b.com")
+	if err != nil {
+		t.Errorf("GetUser: %s", err)
+	}
+	_, err = os.Stat(tmpPath)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temp file still there: %v", err)
+	}
+}
+
+func TestCrashBetweenSnapshotAndTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db := openTestDB(t, path, FlushEveryWrite)
+	chirp, err := db.CreateChirp("first", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %s", err)
+	}
+
+	crashAfterSnapshot(t, func() bool { return true })
+	// the snapshot now holds these, and so does the log
+	_, err = db.CreateChirp("second", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %s", err)
+	}
+	err = db.DeleteChirpByID(chirp.ID, 1)
+	if err != nil {
+		t.Fatalf("DeleteChirpByID: %s", err)
+	}
+	afterSnapshot = func() error { return nil }
+
+	db = openTestDB(t, path, FlushEveryWrite)
+	page, err := db.GetChirps(ChirpsQuery{})
+	if err != nil {
+		t.Fatalf("GetChirps: %s", err)
+	}
+	if len(page.Chirps) != 1 || page.Chirps[0].Body != "second" {
+		t.Errorf("chirps after replaying over the snapshot = %+v, want only the second", page.Chirps)
+	}
+
+	third, err := db.CreateChirp("third", 1)
+	if err != nil {
+		t.Fatalf("CreateChirp: %s", err)
+	}
+	if third.ID != 3 {
+		t.Errorf("ID after replaying over the snapshot = %d, want 3", third.ID)
+	}
+}
+
+func TestCrashBetweenMigratedSnapshotAndTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	// a version 2 file, whose refresh tokens are plaintext and keyed by
+	// user ID, with a token only in its log
+	snapshot := `{"schema_version":2,"users":{"1":{"id":1,"email":"a@b.com","password":"hash"}},"sequences":{"users":1}}`
+	expires, _ := json.Marshal(time.Now().Add(time.Hour).UTC())
+	record := `{"entries":[{"op":"put","table":"tokens","id":1,"value":` +
+		`{"refresh_token":"deadbeef","user_id":1,"token_expiration_date":` + string(expires) + `}}]}` + "\n"
+
+	err := os.WriteFile(path, []byte(snapshot), 0644)
+	if err == nil {
+		err = os.WriteFile(path+".wal", []byte(record), 0644)
+	}
+	if err != nil {
+		t.Fatalf("writing version 2 file: %s", err)
+	}
+
+	// die right after the migrated snapshot is on disk
+	crashAfterSnapshot(t, func() bool {
+		var s DBStructure
+		file, err := os.ReadFile(path)
+		if err != nil || json.Unmarshal(file, &s) != nil {
+			return false
+		}
+		return s.SchemaVersion == latestSchemaVersion()
+	})
+	_, err = NewDB(path, FlushPolicy{Mode: FlushEveryWrite})
+	if !errors.Is(err, errCrash) {
+		t.Fatalf("NewDB: err = %v, want the simulated crash", err)
+	}
+	afterSnapshot = func() error { return nil }
+
+	db := openTestDB(t, path, FlushEveryWrite)
+	token, err := db.GetToken("deadbeef")
+	if err != nil {
+		t.Fatalf("GetToken after the crash: %s", err)
+	}
+	if token.SessionID == 0 {
+		t.Errorf("token = %+v, want it in a session", token)
+	}
+	// nothing of the old log may have been replayed over migrated data
+	for id, token := range db.data.Tokens {
+		if token.RefreshToken != "" || token.TokenHash == "" {
+			t.Errorf("token %d = %+v, want it hashed", id, token)
+		}
+	}
+	if len(db.data.Tokens) != 1 {
+		t.Errorf("got %d tokens, want 1", len(db.data.Tokens))
+	}
+	if db.data.SchemaVersion != latestSchemaVersion() {
+		t.Errorf("schema version = %d, want %d", db.data.SchemaVersion, latestSchemaVersion())
+	}
+}
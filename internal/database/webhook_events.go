@@ -0,0 +1,303 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// WebhookSourcePolka is the source of webhooks sent by Polka, our
+// payment provider
+const WebhookSourcePolka = "polka"
+
+// Statuses of a WebhookEvent
+const (
+	// WebhookPending events are waiting for their next attempt
+	WebhookPending = "pending"
+	// WebhookProcessed events were applied
+	WebhookProcessed = "processed"
+	// WebhookIgnored events were handled but changed nothing
+	WebhookIgnored = "ignored"
+	// WebhookFailed events won't be retried unless replayed
+	WebhookFailed = "failed"
+)
+
+var (
+	// ErrWebhookProcessed is returned for webhook events that were
+	// already applied, which mustn't be applied again
+	ErrWebhookProcessed = errors.New("webhook event was already processed")
+	// ErrWebhookClaimed is returned for webhook events someone is
+	// processing right now
+	ErrWebhookClaimed = errors.New("webhook event is being processed")
+)
+
+// WebhookEvent is an inbound webhook delivery, kept from the moment it
+// arrives so that one failing to process can be retried
+type WebhookEvent struct {
+	ReceivedAt time.Time `json:"received_at"`
+	// NextAttemptAt is when a pending event is due. Whoever is
+	// processing it pushes it ahead, so nobody else picks it up.
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+	Source        string     `json:"source,omitempty"`
+	// DeliveryID identifies the delivery within Source, a redelivery keeps it
+	DeliveryID string `json:"delivery_id,omitempty"`
+	Event      string `json:"event,omitempty"`
+	// Payload is the body exactly as it was received
+	Payload   string `json:"payload,omitempty"`
+	Status    string `json:"status,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	ID        int    `json:"id,omitempty"`
+	Attempts  int    `json:"attempts,omitempty"`
+}
+
+// ProcessedWebhook is how processed deliveries were remembered before
+// the inbox. It's only read to migrate them.
+type ProcessedWebhook struct {
+	ProcessedAt time.Time `json:"processed_at"`
+	WebhookID   string    `json:"webhook_id"`
+	Event       string    `json:"event,omitempty"`
+	ID          int       `json:"id,omitempty"`
+}
+
+// ReceiveWebhookEvent saves a delivery as pending, claimed until
+// claimUntil by the caller. It returns ErrAlreadyExists if a delivery
+// of the same ID was received before.
+func (db *DB) ReceiveWebhookEvent(source, deliveryID, event, payload string, claimUntil time.Time) (WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if deliveryID != "" {
+		if _, ok := db.idx.webhookEventsByDelivery[deliveryKey(source, deliveryID)]; ok {
+			return WebhookEvent{}, ErrAlreadyExists
+		}
+	}
+
+	claimUntil = claimUntil.UTC()
+	webhookEvent := WebhookEvent{
+		ID:            db.data.nextID(tableWebhookEvents),
+		Source:        source,
+		DeliveryID:    deliveryID,
+		Event:         event,
+		Payload:       payload,
+		Status:        WebhookPending,
+		ReceivedAt:    time.Now().UTC(),
+		NextAttemptAt: &claimUntil,
+	}
+
+	err := db.commit(put(tableWebhookEvents, webhookEvent.ID, webhookEvent))
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhookEvent, nil
+}
+
+// GetWebhookEvent returns the webhook event of the given ID
+func (db *DB) GetWebhookEvent(ID int) (WebhookEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	webhookEvent, ok := db.data.WebhookEvents[ID]
+	if !ok {
+		return WebhookEvent{}, ErrNotFound
+	}
+
+	return webhookEvent, nil
+}
+
+// ListWebhookEvents returns the latest limit webhook events, newest
+// first, only those of status when it's set
+func (db *DB) ListWebhookEvents(status string, limit int) ([]WebhookEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	webhookEvents := []WebhookEvent{}
+	for _, webhookEvent := range db.data.WebhookEvents {
+		if status == "" || webhookEvent.Status == status {
+			webhookEvents = append(webhookEvents, webhookEvent)
+		}
+	}
+
+	slices.SortFunc(webhookEvents, func(a, b WebhookEvent) int {
+		return b.ID - a.ID
+	})
+	if limit > 0 && len(webhookEvents) > limit {
+		webhookEvents = webhookEvents[:limit]
+	}
+
+	return webhookEvents, nil
+}
+
+// ClaimDueWebhookEvents returns up to limit pending webhook events due
+// by now, oldest due first, claiming them until claimUntil
+func (db *DB) ClaimDueWebhookEvents(now, claimUntil time.Time, limit int) ([]WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	var due []WebhookEvent
+	for _, webhookEvent := range db.data.WebhookEvents {
+		if webhookEvent.Status == WebhookPending && webhookEvent.NextAttemptAt != nil && !webhookEvent.NextAttemptAt.After(now) {
+			due = append(due, webhookEvent)
+		}
+	}
+
+	slices.SortFunc(due, func(a, b WebhookEvent) int {
+		if c := a.NextAttemptAt.Compare(*b.NextAttemptAt); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+	if limit > 0 && len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimUntil = claimUntil.UTC()
+	claimed := []WebhookEvent{}
+	for _, webhookEvent := range due {
+		webhookEvent.NextAttemptAt = &claimUntil
+
+		err := db.commit(put(tableWebhookEvents, webhookEvent.ID, webhookEvent))
+		if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, webhookEvent)
+	}
+
+	return claimed, nil
+}
+
+// ClaimWebhookEvent makes the webhook event of the given ID pending
+// again, claimed until claimUntil. It returns ErrWebhookProcessed for
+// processed events and ErrWebhookClaimed for pending ones whose claim
+// hasn't run out by now.
+func (db *DB) ClaimWebhookEvent(ID int, now, claimUntil time.Time) (WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	webhookEvent, ok := db.data.WebhookEvents[ID]
+	if !ok {
+		return WebhookEvent{}, ErrNotFound
+	}
+	if webhookEvent.Status == WebhookProcessed {
+		return WebhookEvent{}, ErrWebhookProcessed
+	}
+	if webhookEvent.Status == WebhookPending && webhookEvent.NextAttemptAt != nil && webhookEvent.NextAttemptAt.After(now) {
+		return WebhookEvent{}, ErrWebhookClaimed
+	}
+
+	claimUntil = claimUntil.UTC()
+	webhookEvent.Status = WebhookPending
+	webhookEvent.NextAttemptAt = &claimUntil
+
+	err := db.commit(put(tableWebhookEvents, webhookEvent.ID, webhookEvent))
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhookEvent, nil
+}
+
+// ApplyWebhookEvent applies change to the subscription of a given user
+// and records the webhook event of the given ID as processed at now, in
+// the same commit, so an event is never applied without the record of
+// it. It returns ErrWebhookProcessed if the event already was.
+func (db *DB) ApplyWebhookEvent(ID, userID int, change func(sub *Subscription) error, now time.Time) (WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	webhookEvent, ok := db.data.WebhookEvents[ID]
+	if !ok {
+		return WebhookEvent{}, ErrNotFound
+	}
+	if webhookEvent.Status == WebhookProcessed {
+		return WebhookEvent{}, ErrWebhookProcessed
+	}
+
+	user, err := db.changeSubscription(userID, change)
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+	webhookEvent = webhookEvent.attempted(WebhookProcessed, "", nil, now)
+
+	err = db.commit(
+		put(tableUsers, userID, user),
+		put(tableWebhookEvents, webhookEvent.ID, webhookEvent),
+	)
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhookEvent, nil
+}
+
+// RecordWebhookAttempt records the outcome of processing the webhook
+// event of the given ID at now. Pending events are retried at
+// nextAttemptAt, processed and ignored ones are done.
+func (db *DB) RecordWebhookAttempt(ID int, status, lastError string, nextAttemptAt *time.Time, now time.Time) (WebhookEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	webhookEvent, ok := db.data.WebhookEvents[ID]
+	if !ok {
+		return WebhookEvent{}, ErrNotFound
+	}
+	webhookEvent = webhookEvent.attempted(status, lastError, nextAttemptAt, now)
+
+	err := db.commit(put(tableWebhookEvents, webhookEvent.ID, webhookEvent))
+	if err != nil {
+		return WebhookEvent{}, err
+	}
+
+	return webhookEvent, nil
+}
+
+// PurgeWebhookEvents deletes the webhook events received before
+// receivedBefore that are done with, processed, ignored or failed,
+// returning how many it deleted. Pending ones are kept until they are.
+func (db *DB) PurgeWebhookEvents(receivedBefore time.Time) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	var entries []walEntry
+	for id, webhookEvent := range db.data.WebhookEvents {
+		if webhookEvent.Status != WebhookPending && webhookEvent.ReceivedAt.Before(receivedBefore) {
+			entries = append(entries, del(tableWebhookEvents, id))
+		}
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	err := db.commit(entries...)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(entries), nil
+}
+
+// attempted returns the webhook event with an attempt at now recorded
+func (e WebhookEvent) attempted(status, lastError string, nextAttemptAt *time.Time, now time.Time) WebhookEvent {
+	e.Attempts++
+	e.Status = status
+	e.LastError = lastError
+
+	e.NextAttemptAt = nil
+	if nextAttemptAt != nil {
+		next := nextAttemptAt.UTC()
+		e.NextAttemptAt = &next
+	}
+
+	e.ProcessedAt = nil
+	if status == WebhookProcessed || status == WebhookIgnored {
+		processedAt := now.UTC()
+		e.ProcessedAt = &processedAt
+	}
+
+	return e
+}
+
+func deliveryKey(source, deliveryID string) string {
+	return source + "/" + deliveryID
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClaimWebhookEvent(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			now := time.Now()
+			webhookEvent, err := db.ReceiveWebhookEvent(WebhookSourcePolka, "1", "user.upgraded", "{}", now.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("ReceiveWebhookEvent: %s", err)
+			}
+
+			_, err = db.ClaimWebhookEvent(webhookEvent.ID, now, now.Add(time.Minute))
+			if !errors.Is(err, ErrWebhookClaimed) {
+				t.Errorf("claiming while the receiver holds it: err = %v, want ErrWebhookClaimed", err)
+			}
+
+			later := now.Add(2 * time.Minute)
+			claimed, err := db.ClaimWebhookEvent(webhookEvent.ID, later, later.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("claiming once the claim ran out: %s", err)
+			}
+			if claimed.Status != WebhookPending || !claimed.NextAttemptAt.Equal(later.Add(time.Minute)) {
+				t.Errorf("claimed event = %+v, want it pending until %s", claimed, later.Add(time.Minute))
+			}
+
+			_, err = db.RecordWebhookAttempt(webhookEvent.ID, WebhookProcessed, "", nil, later)
+			if err != nil {
+				t.Fatalf("RecordWebhookAttempt: %s", err)
+			}
+			_, err = db.ClaimWebhookEvent(webhookEvent.ID, later, later.Add(time.Minute))
+			if !errors.Is(err, ErrWebhookProcessed) {
+				t.Errorf("claiming a processed event: err = %v, want ErrWebhookProcessed", err)
+			}
+
+			_, err = db.ClaimWebhookEvent(webhookEvent.ID+1, later, later.Add(time.Minute))
+			if !errors.Is(err, ErrNotFound) {
+				t.Errorf("claiming a missing event: err = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestApplyWebhookEventOnlyOnce(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			db := open(t, dir)
+
+			user, err := db.CreateUser("a@b.com", "hash")
+			if err != nil {
+				t.Fatalf("CreateUser: %s", err)
+			}
+			now := time.Now()
+			webhookEvent, err := db.ReceiveWebhookEvent(WebhookSourcePolka, "1", "subscription.renewed", "{}", now.Add(time.Minute))
+			if err != nil {
+				t.Fatalf("ReceiveWebhookEvent: %s", err)
+			}
+
+			renew := func(sub *Subscription) error {
+				sub.Plan = PlanChirpyRed
+				sub.Status = SubscriptionActive
+				sub.CurrentPeriodEnd = sub.CurrentPeriodEnd.Add(SubscriptionPeriod)
+				return nil
+			}
+
+			applied, err := db.ApplyWebhookEvent(webhookEvent.ID, user.ID, renew, now)
+			if err != nil {
+				t.Fatalf("ApplyWebhookEvent: %s", err)
+			}
+			if applied.Status != WebhookProcessed || applied.Attempts != 1 || applied.ProcessedAt == nil {
+				t.Errorf("applied event = %+v, want it processed after one attempt", applied)
+			}
+
+			// the change and the record of it survive together
+			err = db.Close()
+			if err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+			db = open(t, dir)
+			defer db.Close()
+
+			_, err = db.ApplyWebhookEvent(webhookEvent.ID, user.ID, renew, now)
+			if !errors.Is(err, ErrWebhookProcessed) {
+				t.Errorf("applying it again: err = %v, want ErrWebhookProcessed", err)
+			}
+
+			got, err := db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserByID: %s", err)
+			}
+			want := time.Time{}.Add(SubscriptionPeriod)
+			if got.Subscription == nil || !got.Subscription.CurrentPeriodEnd.Equal(want) {
+				t.Errorf("subscription = %+v, want it renewed once, until %s", got.Subscription, want)
+			}
+		})
+	}
+}
+
+func TestPurgeWebhookEvents(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			db := open(t, t.TempDir())
+			defer db.Close()
+
+			now := time.Now()
+			statuses := []string{WebhookPending, WebhookProcessed, WebhookIgnored, WebhookFailed}
+			for i, status := range statuses {
+				webhookEvent, err := db.ReceiveWebhookEvent(WebhookSourcePolka, status, "user.upgraded", "{}", now.Add(time.Minute))
+				if err != nil {
+					t.Fatalf("ReceiveWebhookEvent %d: %s", i, err)
+				}
+				if status == WebhookPending {
+					continue
+				}
+				_, err = db.RecordWebhookAttempt(webhookEvent.ID, status, "", nil, now)
+				if err != nil {
+					t.Fatalf("RecordWebhookAttempt %d: %s", i, err)
+				}
+			}
+
+			// nothing was received long enough ago
+			n, err := db.PurgeWebhookEvents(now.Add(-time.Hour))
+			if err != nil {
+				t.Fatalf("PurgeWebhookEvents: %s", err)
+			}
+			if n != 0 {
+				t.Errorf("purged %d webhook events received after the cutoff, want 0", n)
+			}
+
+			n, err = db.PurgeWebhookEvents(now.Add(time.Hour))
+			if err != nil {
+				t.Fatalf("PurgeWebhookEvents: %s", err)
+			}
+			if n != 3 {
+				t.Errorf("purged %d webhook events, want 3", n)
+			}
+
+			left, err := db.ListWebhookEvents("", 0)
+			if err != nil {
+				t.Fatalf("ListWebhookEvents: %s", err)
+			}
+			if len(left) != 1 || left[0].Status != WebhookPending {
+				t.Errorf("webhook events left = %+v, want only the pending one", left)
+			}
+
+			// the delivery ID of a purged event is free again
+			_, err = db.ReceiveWebhookEvent(WebhookSourcePolka, WebhookProcessed, "user.upgraded", "{}", now.Add(time.Minute))
+			if err != nil {
+				t.Errorf("ReceiveWebhookEvent of a purged delivery: %s", err)
+			}
+		})
+	}
+}
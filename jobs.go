@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// runJob runs job in the background, right away and then every
+// interval until ctx is done. jobs tracks it so that shutdown can
+// wait for a run in progress.
+func runJob(ctx context.Context, jobs *sync.WaitGroup, interval time.Duration, job func(now time.Time)) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		now := time.Now()
+		for {
+			job(now)
+
+			select {
+			case <-ctx.Done():
+				return
+			case now = <-ticker.C:
+			}
+		}
+	}()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const (
+	errBadCredentials = "incorrect email or password"
+	errLoginThrottled = "too many failed login attempts, try again later"
+
+	auditLoginLocked     = "login_locked"
+	auditAccountUnlocked = "account_unlocked"
+)
+
+var (
+	// accountBackoff lets an account fail a few logins, then doubles
+	// the wait after each further failure, up to a lockout of max
+	accountBackoff = backoff{free: 5, base: time.Second, max: 15 * time.Minute}
+	// ipBackoff is more lenient since many users can share an IP
+	ipBackoff = backoff{free: 20, base: time.Second, max: 15 * time.Minute}
+)
+
+// loginForgetAfter is how long an IP or email has to stay quiet for
+// its failures to be forgotten, IPs have no successful login to reset
+// them and unknown emails never have one
+const loginForgetAfter = time.Hour
+
+// backoff is how long to wait before trying again after failures
+type backoff struct {
+	free int
+	base time.Duration
+	max  time.Duration
+}
+
+// delay is the wait after the given number of failures
+func (b backoff) delay(failures int) time.Duration {
+	if failures < b.free {
+		return 0
+	}
+
+	d := b.base
+	for range failures - b.free {
+		d *= 2
+		if d >= b.max {
+			return b.max
+		}
+	}
+	return d
+}
+
+// retryAfter is how long is left to wait at now
+// when the last of failures happened at last
+func (b backoff) retryAfter(failures int, last, now time.Time) time.Duration {
+	return max(last.Add(b.delay(failures)).Sub(now), 0)
+}
+
+// loginThrottle counts failed logins per key, a client IP or an
+// email, or any other attempt that mustn't be repeated at will, like
+// password reset requests. It lives in memory, a restart gives every
+// key a clean slate. The lockout of accounts doesn't rely on it, see
+// checkAccountLock.
+type loginThrottle struct {
+	mux      sync.Mutex
+	policy   backoff
+	failures map[string]loginFailures
+}
+
+type loginFailures struct {
+	last  time.Time
+	count int
+}
+
+func newLoginThrottle(policy backoff) *loginThrottle {
+	return &loginThrottle{
+		policy:   policy,
+		failures: make(map[string]loginFailures),
+	}
+}
+
+// reserve counts an attempt of key as failed before it's checked, so
+// that guesses made in parallel each see the ones before them. When key
+// failed too many times to try again yet, it counts nothing and returns
+// how long is left to wait.
+func (t *loginThrottle) reserve(key string, now time.Time) (time.Duration, bool) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	f := t.failures[key]
+	if now.Sub(f.last) > loginForgetAfter {
+		f.count = 0
+	}
+	if wait := t.policy.retryAfter(f.count, f.last, now); wait > 0 {
+		return wait, false
+	}
+
+	f.count++
+	f.last = now
+	t.failures[key] = f
+
+	// keep the map from growing with keys that went quiet
+	if len(t.failures) > 10000 {
+		for key, f := range t.failures {
+			if now.Sub(f.last) > loginForgetAfter {
+				delete(t.failures, key)
+			}
+		}
+	}
+
+	return 0, true
+}
+
+// release takes back the failure reserve counted for an attempt
+// that succeeded
+func (t *loginThrottle) release(key string) {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		return
+	}
+	f.count--
+	if f.count <= 0 {
+		delete(t.failures, key)
+	} else {
+		t.failures[key] = f
+	}
+}
+
+// reset forgets the failed logins of key, reporting whether there were any
+func (t *loginThrottle) reset(key string) bool {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+
+	_, ok := t.failures[key]
+	delete(t.failures, key)
+	return ok
+}
+
+func emailKey(email string) string {
+	return strings.ToLower(email)
+}
+
+// reserveLogin counts an attempt on email from the client IP as failed
+// until releaseLogin says otherwise, and answers 429 instead when either
+// failed too many logins to try again yet. Emails are throttled whether
+// or not they belong to an account, so a 429 doesn't tell which do.
+func (cfg *apiConfig) reserveLogin(w http.ResponseWriter, r *http.Request, email string) bool {
+	return reserveAttempt(w, r, cfg.loginIPs, cfg.loginEmails, email, errLoginThrottled)
+}
+
+// reserveAttempt counts an attempt on email from the client IP in ips
+// and emails, or answers 429 with msg when either throttle says to wait
+func reserveAttempt(w http.ResponseWriter, r *http.Request, ips, emails *loginThrottle, email, msg string) bool {
+	now := time.Now()
+	ip := clientIP(r)
+
+	wait, ok := ips.reserve(ip, now)
+	if ok {
+		wait, ok = emails.reserve(emailKey(email), now)
+		if !ok {
+			ips.release(ip)
+		}
+	}
+	if ok {
+		return true
+	}
+
+	respondRateLimited(w, wait, msg)
+	return false
+}
+
+// releaseLogin takes back what reserveLogin counted once the
+// credentials turned out right, or were never checked
+func (cfg *apiConfig) releaseLogin(r *http.Request, email string) {
+	cfg.loginIPs.release(clientIP(r))
+	cfg.loginEmails.release(emailKey(email))
+}
+
+// checkAccountLock answers 429 when dbUser failed too many logins to
+// try again yet, going by the failures stored with the account. That's
+// the lockout which is audited and which admins see and unlock, and it
+// holds across restarts and instances. The in-memory throttles come on
+// top of it: they count attempts before they're checked, so guesses
+// made in parallel see each other, and they cover emails of no account.
+func (cfg *apiConfig) checkAccountLock(w http.ResponseWriter, r *http.Request, dbUser database.User) bool {
+	now := time.Now()
+	last := dbUser.LastFailedLoginAt
+	if last == nil || now.Sub(*last) > loginForgetAfter {
+		return true
+	}
+
+	wait := accountBackoff.retryAfter(dbUser.FailedLogins, *last, now)
+	if wait == 0 {
+		return true
+	}
+
+	cfg.releaseLogin(r, dbUser.Email)
+	respondRateLimited(w, wait, errLoginThrottled)
+	return false
+}
+
+// loginFailed records a failed login of dbUser, unless the email
+// matched no user. The throttles already counted it in reserveLogin,
+// the stored count is what checkAccountLock enforces.
+func (cfg *apiConfig) loginFailed(r *http.Request, dbUser database.User) {
+	if dbUser.ID == 0 {
+		return
+	}
+
+	updated, err := cfg.db.RecordLoginFailure(dbUser.ID, time.Now().Add(-loginForgetAfter))
+	if err != nil {
+		log.Printf("Error recording failed login of user %d: %s", dbUser.ID, err)
+		return
+	}
+
+	if updated.FailedLogins == accountBackoff.free {
+		cfg.audit(r, auditLoginLocked, updated.ID, 0)
+	}
+}
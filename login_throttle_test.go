@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAccountLockSurvivesRestart(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	passwords, err := auth.NewPasswordHasher(auth.HashBcrypt, bcrypt.MinCost, auth.DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher: %s", err)
+	}
+	hash, err := passwords.Hash("right password")
+	if err != nil {
+		t.Fatalf("Hash: %s", err)
+	}
+	user, err := db.CreateUser("a@b.com", hash)
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+
+	// newConfig is the server after a restart, with empty throttles
+	newConfig := func() *apiConfig {
+		return &apiConfig{
+			db:          db,
+			jwtKeys:     auth.NewHMACKeySet("secret"),
+			passwords:   passwords,
+			loginIPs:    newLoginThrottle(ipBackoff),
+			loginEmails: newLoginThrottle(accountBackoff),
+		}
+	}
+	login := func(cfg *apiConfig, password string) int {
+		r := httptest.NewRequest(http.MethodPost, "/api/login",
+			strings.NewReader(`{"email":"a@b.com","password":"`+password+`"}`))
+		w := httptest.NewRecorder()
+		cfg.login(w, r)
+		return w.Code
+	}
+
+	cfg := newConfig()
+	for i := range accountBackoff.free {
+		if code := login(cfg, "wrong password"); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: status = %d, want %d", i, code, http.StatusUnauthorized)
+		}
+	}
+
+	cfg = newConfig()
+	if code := login(cfg, "right password"); code != http.StatusTooManyRequests {
+		t.Errorf("login of a locked account after a restart: status = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	err = db.ResetLoginFailures(user.ID)
+	if err != nil {
+		t.Fatalf("ResetLoginFailures: %s", err)
+	}
+	if code := login(cfg, "right password"); code != http.StatusOK {
+		t.Errorf("login of an unlocked account: status = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -1,37 +1,175 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/luispinto23/chirpy-new/internal/auth"
 	"github.com/luispinto23/chirpy-new/internal/database"
+	"github.com/luispinto23/chirpy-new/internal/mail"
 )
 
 type apiConfig struct {
-	db             database.DB
-	jwtSecret      string
+	db             database.Store
+	jwtKeys        *auth.KeySet
 	polkaApiKey    string
 	fileServerHits int
+
+	// polkaWebhookSecret signs Polka webhooks. Without it
+	// they're authenticated with polkaApiKey alone.
+	polkaWebhookSecret string
+
+	// chirpRestoreGrace turns on soft deletes: deleted chirps
+	// can be restored by their author for this long
+	chirpRestoreGrace time.Duration
+	// subscriptionGrace is how long Chirpy Red is kept
+	// after a payment failed
+	subscriptionGrace time.Duration
+
+	mailer mail.Mailer
+	// appBaseURL is where links in emails point to
+	appBaseURL string
+	// unverifiedRestrictions lists what users can't do
+	// until they verified their email
+	unverifiedRestrictions []string
+
+	// loginIPs and loginEmails throttle the IPs and emails
+	// failing too many logins
+	loginIPs    *loginThrottle
+	loginEmails *loginThrottle
+	// resetIPs and resetEmails throttle password reset requests
+	resetIPs    *loginThrottle
+	resetEmails *loginThrottle
+	// chirpRates enforces the ChirpsPerHour entitlement
+	chirpRates *rateLimiter
+
+	passwords      *auth.PasswordHasher
+	passwordPolicy *auth.PasswordPolicy
+
+	// jobs tracks the background jobs and mails, shutdown waits
+	// for them before closing the store
+	jobs sync.WaitGroup
 }
 
 func main() {
+	migrateOnly := flag.Bool("migrate-only", false, "migrate the database to the latest schema and exit")
+	flag.Parse()
+
 	godotenv.Load()
 	mux := http.NewServeMux()
 
-	db, err := database.NewDB("database.json")
+	flushPolicy, err := flushPolicyFromEnv(os.Getenv("DB_FLUSH"), os.Getenv("DB_FLUSH_INTERVAL_MS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	db, err := openStore(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), flushPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, m := range db.Migrations() {
+		log.Printf("migrated the database to schema version %d: %s", m.Version, m.Description)
+	}
+
+	if *migrateOnly {
+		err = db.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("database is up to date")
+		return
+	}
+
+	passwords, err := passwordHasherFromEnv(os.Getenv("PASSWORD_HASH"), os.Getenv("BCRYPT_COST"),
+		os.Getenv("ARGON2_MEMORY_KIB"), os.Getenv("ARGON2_ITERATIONS"), os.Getenv("ARGON2_PARALLELISM"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	passwordPolicy, err := passwordPolicyFromEnv(os.Getenv("PASSWORD_MIN_LENGTH"), os.Getenv("PASSWORD_MAX_LENGTH"),
+		os.Getenv("BREACHED_PASSWORDS_FILE"), passwords.MaxLength())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = bootstrapAdmin(db, passwords, os.Getenv("ADMIN_EMAIL"), os.Getenv("ADMIN_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	jwtKeys, err := loadJWTKeys(os.Getenv("JWT_KEYS_DIR"), os.Getenv("JWT_SIGNING_KID"), os.Getenv("JWT_SECRET"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaApiKey := os.Getenv("POLKA_API_KEY")
+	polkaWebhookSecret := os.Getenv("POLKA_WEBHOOK_SECRET")
+	if polkaWebhookSecret == "" {
+		log.Println("POLKA_WEBHOOK_SECRET isn't set, Polka webhooks are only checked against POLKA_API_KEY")
+	}
+
+	var chirpRestoreGrace time.Duration
+	if grace := os.Getenv("CHIRP_SOFT_DELETE_GRACE"); grace != "" {
+		chirpRestoreGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			log.Fatalf("invalid CHIRP_SOFT_DELETE_GRACE: %s", err)
+		}
+	}
+
+	subscriptionGrace := defaultSubscriptionGrace
+	if grace := os.Getenv("CHIRPY_RED_GRACE_PERIOD"); grace != "" {
+		subscriptionGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			log.Fatalf("invalid CHIRPY_RED_GRACE_PERIOD: %s", err)
+		}
+	}
+
+	mailer, err := openMailer(os.Getenv("MAIL_DRIVER"), os.Getenv("MAIL_FROM"), os.Getenv("MAIL_LOG_FILE"),
+		os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	unverifiedRestrictions, err := parseRestrictions(os.Getenv("UNVERIFIED_RESTRICTIONS"))
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	apicfg := apiConfig{
 		fileServerHits: 0,
-		db:             *db,
-		jwtSecret:      jwtSecret,
+		db:             db,
+		jwtKeys:        jwtKeys,
 		polkaApiKey:    polkaApiKey,
+
+		polkaWebhookSecret: polkaWebhookSecret,
+
+		chirpRestoreGrace: chirpRestoreGrace,
+		subscriptionGrace: subscriptionGrace,
+
+		mailer:                 mailer,
+		appBaseURL:             strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/"),
+		unverifiedRestrictions: unverifiedRestrictions,
+
+		loginIPs:    newLoginThrottle(ipBackoff),
+		loginEmails: newLoginThrottle(accountBackoff),
+		resetIPs:    newLoginThrottle(resetIPBackoff),
+		resetEmails: newLoginThrottle(resetEmailBackoff),
+		chirpRates:  newRateLimiter(time.Hour),
+
+		passwords:      passwords,
+		passwordPolicy: passwordPolicy,
 	}
 
 	srv := http.Server{
@@ -45,22 +183,307 @@ func main() {
 	mux.Handle(appPath, apicfg.middlewareMetricsInc(fileHandler))
 
 	mux.HandleFunc("GET /api/healthz", healthHandler)
-	mux.HandleFunc("GET /admin/metrics", apicfg.metricsHandler)
-	mux.HandleFunc("GET /api/reset", apicfg.resetMetrics)
+	mux.HandleFunc("GET /.well-known/jwks.json", apicfg.jwks)
+	mux.Handle("GET /admin/metrics", apicfg.requireRole(http.HandlerFunc(apicfg.metricsHandler), database.RoleAdmin))
+	mux.Handle("GET /api/reset", apicfg.requireRole(http.HandlerFunc(apicfg.resetMetrics), database.RoleAdmin))
+	mux.Handle("PUT /api/admin/users/{userID}/roles", apicfg.requireRole(http.HandlerFunc(apicfg.setUserRoles), database.RoleAdmin))
+	mux.Handle("POST /api/admin/users/{userID}/unlock", apicfg.requireRole(http.HandlerFunc(apicfg.unlockUser), database.RoleAdmin))
+	mux.Handle("POST /api/admin/ips/{ip}/unlock", apicfg.requireRole(http.HandlerFunc(apicfg.unlockIP), database.RoleAdmin))
+	mux.Handle("GET /api/admin/webhook-events", apicfg.requireRole(http.HandlerFunc(apicfg.listWebhookEvents), database.RoleAdmin))
+	mux.Handle("GET /api/admin/webhook-events/{eventID}", apicfg.requireRole(http.HandlerFunc(apicfg.getWebhookEvent), database.RoleAdmin))
+	mux.Handle("POST /api/admin/webhook-events/{eventID}/replay", apicfg.requireRole(http.HandlerFunc(apicfg.replayWebhookEvent), database.RoleAdmin))
+	mux.Handle("DELETE /api/moderation/chirps/{chirpID}", apicfg.requireRole(http.HandlerFunc(apicfg.removeChirp), database.RoleModerator, database.RoleAdmin))
 
-	mux.HandleFunc("POST /api/chirps", apicfg.createChirp)
+	mux.Handle("POST /api/chirps", apicfg.requireAuth(apicfg.requireVerified(restrictChirps, http.HandlerFunc(apicfg.createChirp)), auth.ScopeChirpsWrite))
 	mux.HandleFunc("GET /api/chirps", apicfg.getChirps)
 	mux.HandleFunc("GET /api/chirps/{chirpID}", apicfg.getChirp)
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apicfg.deleteChirp)
+	mux.Handle("PUT /api/chirps/{chirpID}", apicfg.requireAuth(apicfg.requireVerified(restrictChirps, http.HandlerFunc(apicfg.editChirp)), auth.ScopeChirpsWrite))
+	mux.Handle("GET /api/chirps/scheduled", apicfg.requireAuth(http.HandlerFunc(apicfg.listScheduledChirps), auth.ScopeChirpsRead))
+	mux.Handle("DELETE /api/chirps/scheduled/{scheduledID}", apicfg.requireAuth(http.HandlerFunc(apicfg.cancelScheduledChirp), auth.ScopeChirpsWrite))
+	mux.Handle("DELETE /api/chirps/{chirpID}", apicfg.requireAuth(http.HandlerFunc(apicfg.deleteChirp), auth.ScopeChirpsWrite))
+	mux.Handle("POST /api/chirps/{chirpID}/restore", apicfg.requireAuth(http.HandlerFunc(apicfg.restoreChirp), auth.ScopeChirpsWrite))
 
 	mux.HandleFunc("POST /api/users", apicfg.createUser)
-	mux.HandleFunc("PUT /api/users", apicfg.updateUser)
+	mux.Handle("PUT /api/users", apicfg.requireAuth(http.HandlerFunc(apicfg.updateUser), auth.ScopeAccountWrite))
+	mux.Handle("POST /api/users/verify-email", apicfg.requireAuth(http.HandlerFunc(apicfg.requestEmailVerification), auth.ScopeAccountWrite))
+	mux.HandleFunc("POST /api/users/verify-email/confirm", apicfg.confirmEmailVerification)
+	mux.HandleFunc("POST /api/password-reset", apicfg.requestPasswordReset)
+	mux.HandleFunc("POST /api/password-reset/confirm", apicfg.confirmPasswordReset)
 	mux.HandleFunc("POST /api/login", apicfg.login)
+	mux.HandleFunc("POST /api/login/2fa", apicfg.loginTwoFactor)
+
+	mux.Handle("POST /api/2fa/enroll", apicfg.requireAuth(http.HandlerFunc(apicfg.enrollTOTP), auth.ScopeAccountWrite))
+	mux.Handle("POST /api/2fa/confirm", apicfg.requireAuth(http.HandlerFunc(apicfg.confirmTOTP), auth.ScopeAccountWrite))
+	mux.Handle("POST /api/2fa/disable", apicfg.requireAuth(http.HandlerFunc(apicfg.disableTOTP), auth.ScopeAccountWrite))
 
 	mux.HandleFunc("POST /api/refresh", apicfg.refreshToken)
 	mux.HandleFunc("POST /api/revoke", apicfg.revokeToken)
 
+	mux.Handle("GET /api/sessions", apicfg.requireAuth(http.HandlerFunc(apicfg.listSessions), auth.ScopeAccountRead))
+	mux.Handle("DELETE /api/sessions/{sessionID}", apicfg.requireAuth(http.HandlerFunc(apicfg.revokeSession), auth.ScopeAccountWrite))
+	mux.Handle("POST /api/sessions/revoke-all", apicfg.requireAuth(http.HandlerFunc(apicfg.revokeAllSessions), auth.ScopeAccountWrite))
+
+	mux.Handle("POST /api/access-tokens", apicfg.requireAuth(apicfg.requireVerified(restrictAccessTokens, http.HandlerFunc(apicfg.createAccessToken)), auth.ScopeAccountWrite))
+	mux.Handle("GET /api/access-tokens", apicfg.requireAuth(http.HandlerFunc(apicfg.listAccessTokens), auth.ScopeAccountRead))
+	mux.Handle("DELETE /api/access-tokens/{tokenID}", apicfg.requireAuth(http.HandlerFunc(apicfg.revokeAccessToken), auth.ScopeAccountWrite))
+
 	mux.HandleFunc("POST /api/polka/webhooks", apicfg.polka)
 
-	log.Fatal(srv.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	runJob(ctx, &apicfg.jobs, subscriptionExpiryInterval, apicfg.expireSubscriptions)
+	runJob(ctx, &apicfg.jobs, scheduledChirpsInterval, apicfg.publishScheduledChirps)
+	runJob(ctx, &apicfg.jobs, webhookRetryInterval, apicfg.retryWebhookEvents)
+	runJob(ctx, &apicfg.jobs, sessionPurgeInterval, apicfg.purgeExpiredSessions)
+	runJob(ctx, &apicfg.jobs, chirpPurgeInterval, apicfg.purgeDeletedChirps)
+	runJob(ctx, &apicfg.jobs, webhookPurgeInterval, apicfg.purgeWebhookEvents)
+
+	// ListenAndServe returns as soon as Shutdown starts, the store is
+	// only closed once Shutdown is done waiting for in-flight requests
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(shutdownCtx)
+	}()
+
+	err = srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	err = <-shutdownErr
+	if err != nil {
+		// requests are still running, so the store is left as is, what
+		// they committed is in its log and replayed on the next start
+		log.Fatalf("shutting down: %s", err)
+	}
+
+	stop()
+	apicfg.jobs.Wait()
+
+	err = db.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// openStore opens the storage backend selected by driver,
+// defaulting to the JSON file store
+func openStore(driver, path string, flushPolicy database.FlushPolicy) (database.Store, error) {
+	switch driver {
+	case "", "json":
+		if path == "" {
+			path = "database.json"
+		}
+		return database.NewDB(path, flushPolicy)
+	case "sqlite":
+		if path == "" {
+			path = "database.db"
+		}
+		return database.NewSQLiteDB(path)
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+}
+
+// bootstrapAdmin makes sure the user with the given email is an admin,
+// creating it with password if it doesn't exist yet. It does nothing
+// when no email is configured.
+func bootstrapAdmin(db database.Store, passwords *auth.PasswordHasher, email, password string) error {
+	if email == "" {
+		return nil
+	}
+
+	user, err := db.GetUser(email)
+	if errors.Is(err, database.ErrNotFound) {
+		if password == "" {
+			return fmt.Errorf("admin %s doesn't exist and ADMIN_PASSWORD isn't set", email)
+		}
+
+		hash, err := passwords.Hash(password)
+		if err != nil {
+			return err
+		}
+
+		user, err = db.CreateUser(email, hash)
+		if err != nil {
+			return err
+		}
+		log.Printf("created admin %s", email)
+	} else if err != nil {
+		return err
+	}
+
+	if user.HasRole(database.RoleAdmin) {
+		return nil
+	}
+
+	_, err = db.SetUserRoles(user.ID, append(user.Roles, database.RoleAdmin))
+	if err != nil {
+		return err
+	}
+	log.Printf("granted admin to %s", email)
+	return nil
+}
+
+// openMailer returns the mailer selected by driver. There's no default,
+// a server that only logs its emails wouldn't deliver a single one. The
+// log driver writes emails to logFile, or stderr when it's empty.
+func openMailer(driver, from, logFile, smtpAddr, smtpUsername, smtpPassword string) (mail.Mailer, error) {
+	if from == "" {
+		from = "no-reply@localhost"
+	}
+
+	switch driver {
+	case "":
+		return nil, errors.New("MAIL_DRIVER isn't set, set it to smtp, or to log to only log emails")
+	case "log":
+		if logFile == "" {
+			return mail.NewLogMailer(os.Stderr, from), nil
+		}
+		f, err := os.OpenFile(logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		return mail.NewLogMailer(f, from), nil
+	case "smtp":
+		return mail.NewSMTPMailer(smtpAddr, smtpUsername, smtpPassword, from)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_DRIVER %q", driver)
+	}
+}
+
+// parseRestrictions parses the comma separated UNVERIFIED_RESTRICTIONS
+func parseRestrictions(list string) ([]string, error) {
+	var restrictions []string
+	for _, r := range strings.Split(list, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if !slices.Contains(knownRestrictions, r) {
+			return nil, fmt.Errorf("unknown restriction %q in UNVERIFIED_RESTRICTIONS", r)
+		}
+		restrictions = append(restrictions, r)
+	}
+	return restrictions, nil
+}
+
+// passwordHasherFromEnv builds the password hasher, PASSWORD_HASH
+// is argon2id, the default, or bcrypt. Unset parameters keep
+// their defaults.
+func passwordHasherFromEnv(algorithm, bcryptCost, argon2Memory, argon2Iterations, argon2Parallelism string) (*auth.PasswordHasher, error) {
+	if algorithm == "" {
+		algorithm = auth.HashArgon2id
+	}
+
+	cost, err := intSetting("BCRYPT_COST", bcryptCost, auth.DefaultBcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	params := auth.DefaultArgon2Params
+	memory, err := uintSetting("ARGON2_MEMORY_KIB", argon2Memory, 32, uint64(params.Memory))
+	if err != nil {
+		return nil, err
+	}
+	iterations, err := uintSetting("ARGON2_ITERATIONS", argon2Iterations, 32, uint64(params.Iterations))
+	if err != nil {
+		return nil, err
+	}
+	parallelism, err := uintSetting("ARGON2_PARALLELISM", argon2Parallelism, 8, uint64(params.Parallelism))
+	if err != nil {
+		return nil, err
+	}
+	params.Memory = uint32(memory)
+	params.Iterations = uint32(iterations)
+	params.Parallelism = uint8(parallelism)
+
+	return auth.NewPasswordHasher(algorithm, cost, params)
+}
+
+// passwordPolicyFromEnv builds the password policy. Passwords can't be
+// longer than hashMaxLength, when the hash algorithm has a limit.
+func passwordPolicyFromEnv(minLength, maxLength, breachedFile string, hashMaxLength int) (*auth.PasswordPolicy, error) {
+	minLen, err := intSetting("PASSWORD_MIN_LENGTH", minLength, 8)
+	if err != nil {
+		return nil, err
+	}
+	maxLen, err := intSetting("PASSWORD_MAX_LENGTH", maxLength, 128)
+	if err != nil {
+		return nil, err
+	}
+	if hashMaxLength > 0 {
+		maxLen = min(maxLen, hashMaxLength)
+	}
+	if minLen > maxLen {
+		return nil, fmt.Errorf("PASSWORD_MIN_LENGTH %d is more than the maximum length %d", minLen, maxLen)
+	}
+
+	return auth.NewPasswordPolicy(minLen, maxLen, breachedFile)
+}
+
+// intSetting parses the positive integer value of the setting name,
+// or returns def when it's unset
+func intSetting(name, value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// uintSetting parses the positive value of the setting name that fits
+// in bitSize bits, or returns def when it's unset
+func uintSetting(name, value string, bitSize int, def uint64) (uint64, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, bitSize)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return n, nil
+}
+
+// loadJWTKeys loads the signing keys from keysDir, falling back to
+// HS256 with the shared secret when no directory is configured
+func loadJWTKeys(keysDir, signingKID, secret string) (*auth.KeySet, error) {
+	if keysDir == "" {
+		return auth.NewHMACKeySet(secret), nil
+	}
+	return auth.LoadKeySet(keysDir, signingKID)
+}
+
+// flushPolicyFromEnv builds the JSON store flush policy,
+// DB_FLUSH is one of write, interval or shutdown
+func flushPolicyFromEnv(mode, intervalMs string) (database.FlushPolicy, error) {
+	policy := database.FlushPolicy{ErrorLog: log.Default()}
+
+	flushMode, err := database.ParseFlushMode(mode)
+	if err != nil {
+		return policy, err
+	}
+	policy.Mode = flushMode
+
+	if flushMode == database.FlushInterval {
+		ms := 1000
+		if intervalMs != "" {
+			ms, err = strconv.Atoi(intervalMs)
+			if err != nil || ms <= 0 {
+				return policy, fmt.Errorf("invalid DB_FLUSH_INTERVAL_MS %q", intervalMs)
+			}
+		}
+		policy.Interval = time.Duration(ms) * time.Millisecond
+	}
+
+	return policy, nil
 }
@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestUintSetting(t *testing.T) {
+	tests := []struct {
+		value   string
+		bitSize int
+		want    uint64
+		wantErr bool
+	}{
+		{value: "", bitSize: 32, want: 7},
+		{value: "65536", bitSize: 32, want: 65536},
+		{value: "4294967295", bitSize: 32, want: 4294967295},
+		{value: "4294967296", bitSize: 32, wantErr: true},
+		{value: "255", bitSize: 8, want: 255},
+		{value: "256", bitSize: 8, wantErr: true},
+		{value: "0", bitSize: 32, wantErr: true},
+		{value: "-1", bitSize: 32, wantErr: true},
+		{value: "many", bitSize: 32, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := uintSetting("SETTING", tt.value, tt.bitSize, 7)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("uintSetting(%q, %d): err = %v, want error %t", tt.value, tt.bitSize, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("uintSetting(%q, %d) = %d, want %d", tt.value, tt.bitSize, got, tt.want)
+		}
+	}
+}
+
+func TestOpenMailer(t *testing.T) {
+	tests := []struct {
+		driver  string
+		wantErr bool
+	}{
+		// not choosing one mustn't quietly only log emails
+		{driver: "", wantErr: true},
+		{driver: "log"},
+		{driver: "sendmail", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		_, err := openMailer(tt.driver, "", "", "", "", "")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("openMailer(%q): err = %v, want error %t", tt.driver, err, tt.wantErr)
+		}
+	}
+}
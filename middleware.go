@@ -1,6 +1,45 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+)
+
+type contextKey int
+
+const principalKey contextKey = iota
+
+// principal is the authenticated caller of a request
+type principal struct {
+	UserID int
+	Roles  []string
+
+	// AccessTokenID is set when the caller used a personal access
+	// token, which only allows what its Scopes list
+	AccessTokenID int
+	Scopes        []string
+}
+
+// allows reports whether the caller's credentials cover scope.
+// Access tokens from a login cover everything.
+func (p principal) allows(scope string) bool {
+	return p.AccessTokenID == 0 || slices.Contains(p.Scopes, scope)
+}
+
+// hasRole reports whether the caller has any of roles
+func (p principal) hasRole(roles ...string) bool {
+	for _, role := range roles {
+		if slices.Contains(p.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -8,3 +47,163 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// requireAuth only lets requests with a valid access token through
+// and stores the caller in the request context. Personal access tokens
+// are accepted when they have every one of scopes, so every route
+// lists the scopes it needs. Routes that list none would only take
+// tokens from a login.
+func (cfg *apiConfig) requireAuth(next http.Handler, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenStr, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			respondUnauthorized(w, errors.Is(err, auth.ErrNoAuthHeader), "Missing or malformed bearer token")
+			return
+		}
+
+		var caller principal
+		if auth.IsAccessToken(tokenStr) {
+			caller, err = cfg.accessTokenPrincipal(tokenStr)
+		} else {
+			caller, err = cfg.jwtPrincipal(tokenStr)
+		}
+		if err != nil {
+			respondUnauthorized(w, false, "Invalid token")
+			return
+		}
+
+		if caller.AccessTokenID != 0 && len(scopes) == 0 {
+			respondForbiddenScope(w, "")
+			return
+		}
+		for _, scope := range scopes {
+			if !caller.allows(scope) {
+				respondForbiddenScope(w, scope)
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), principalKey, caller)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// jwtPrincipal returns the caller identified by a JWT from a login
+func (cfg *apiConfig) jwtPrincipal(tokenStr string) (principal, error) {
+	token, err := auth.ValidateJWTToken(tokenStr, cfg.jwtKeys)
+	if err != nil {
+		return principal{}, err
+	}
+
+	claims, ok := token.Claims.(*auth.Claims)
+	if !ok {
+		return principal{}, errors.New("unexpected claims")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return principal{}, err
+	}
+
+	return principal{UserID: userID, Roles: claims.Roles}, nil
+}
+
+// accessTokenPrincipal returns the caller identified by a personal
+// access token. Its roles are read from the user each time, since
+// unlike a JWT the token lives long enough to outlast a change.
+func (cfg *apiConfig) accessTokenPrincipal(tokenStr string) (principal, error) {
+	accessToken, err := cfg.db.UseAccessToken(tokenStr)
+	if err != nil {
+		return principal{}, err
+	}
+
+	var roles []string
+	if slices.Contains(accessToken.Scopes, auth.ScopeAdmin) {
+		dbUser, err := cfg.db.GetUserByID(accessToken.UserID)
+		if err != nil {
+			return principal{}, err
+		}
+		roles = dbUser.Roles
+	}
+
+	return principal{
+		UserID:        accessToken.UserID,
+		Roles:         roles,
+		AccessTokenID: accessToken.ID,
+		Scopes:        accessToken.Scopes,
+	}, nil
+}
+
+// requireRole only lets authenticated callers with any of roles through.
+// Roles come from the access token, so a change takes effect on the
+// caller's next refresh.
+func (cfg *apiConfig) requireRole(next http.Handler, roles ...string) http.Handler {
+	return cfg.requireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := principalFromContext(r.Context())
+		if !caller.hasRole(roles...) {
+			respondWithError(w, http.StatusForbidden, "Forbidden")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}), auth.ScopeAdmin)
+}
+
+// Actions UNVERIFIED_RESTRICTIONS can keep users with an unverified email from
+const (
+	restrictChirps       = "chirps"
+	restrictAccessTokens = "access-tokens"
+)
+
+var knownRestrictions = []string{restrictChirps, restrictAccessTokens}
+
+// requireVerified keeps callers who didn't verify their email from
+// action, when it's one of the configured restrictions. It must run
+// after requireAuth.
+func (cfg *apiConfig) requireVerified(action string, next http.Handler) http.Handler {
+	if !slices.Contains(cfg.unverifiedRestrictions, action) {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caller, _ := principalFromContext(r.Context())
+
+		dbUser, err := cfg.db.GetUserByID(caller.UserID)
+		if err != nil {
+			respondUnauthorized(w, false, "Invalid token")
+			return
+		}
+		if !dbUser.EmailVerified {
+			respondWithError(w, http.StatusForbidden, "Verify your email first")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principalFromContext returns the caller stored by requireAuth
+func principalFromContext(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey).(principal)
+	return p, ok
+}
+
+// respondUnauthorized sends a 401 with the RFC 6750 challenge, leaving
+// out the error code when no credentials were sent at all
+func respondUnauthorized(w http.ResponseWriter, missing bool, msg string) {
+	challenge := `Bearer realm="chirpy"`
+	if !missing {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, http.StatusUnauthorized, msg)
+}
+
+// respondForbiddenScope sends a 403 with the RFC 6750 challenge for a
+// token that is valid but can't be used for this route
+func respondForbiddenScope(w http.ResponseWriter, scope string) {
+	challenge := `Bearer realm="chirpy", error="insufficient_scope"`
+	if scope != "" {
+		challenge += `, scope="` + scope + `"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondWithError(w, http.StatusForbidden, "Insufficient scope")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+func newMiddlewareConfig(t *testing.T) *apiConfig {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return &apiConfig{
+		db:      db,
+		jwtKeys: auth.NewHMACKeySet("secret"),
+	}
+}
+
+// callerID answers with the ID of the caller requireAuth let through
+var callerID = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "no caller in the context")
+		return
+	}
+	respondWithJSON(w, http.StatusOK, caller.UserID)
+})
+
+// serve sends a request to h with authorization as its Authorization header
+func serve(h http.Handler, authorization string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestRequireAuth(t *testing.T) {
+	cfg := newMiddlewareConfig(t)
+
+	token, err := auth.IssueJWT(42, nil, cfg.jwtKeys)
+	if err != nil {
+		t.Fatalf("IssueJWT: %s", err)
+	}
+	otherKeys, err := auth.IssueJWT(42, nil, auth.NewHMACKeySet("other secret"))
+	if err != nil {
+		t.Fatalf("IssueJWT: %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{name: "valid token", authorization: "Bearer " + token, wantStatus: http.StatusOK},
+		{name: "scheme in lowercase", authorization: "bearer " + token, wantStatus: http.StatusOK},
+		// no credentials at all get the challenge without an error code
+		{name: "no header", wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy"`},
+		{name: "other scheme", authorization: "Basic " + token, wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "no token", authorization: "Bearer", wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "extra field", authorization: "Bearer " + token + " more", wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "not a JWT", authorization: "Bearer garbage", wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy", error="invalid_token"`},
+		{name: "signed with another key", authorization: "Bearer " + otherKeys, wantStatus: http.StatusUnauthorized, wantChallenge: `Bearer realm="chirpy", error="invalid_token"`},
+	}
+
+	handler := cfg.requireAuth(callerID)
+	for _, tt := range tests {
+		w := serve(handler, tt.authorization)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+			t.Errorf("%s: WWW-Authenticate = %q, want %q", tt.name, got, tt.wantChallenge)
+		}
+		if tt.wantStatus == http.StatusOK && w.Body.String() != "42" {
+			t.Errorf("%s: caller = %s, want 42", tt.name, w.Body)
+		}
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	cfg := newMiddlewareConfig(t)
+
+	tests := []struct {
+		name       string
+		roles      []string
+		wantStatus int
+	}{
+		{name: "admin", roles: []string{database.RoleUser, database.RoleAdmin}, wantStatus: http.StatusOK},
+		{name: "moderator", roles: []string{database.RoleModerator}, wantStatus: http.StatusForbidden},
+		{name: "user", roles: []string{database.RoleUser}, wantStatus: http.StatusForbidden},
+		{name: "no roles", wantStatus: http.StatusForbidden},
+	}
+
+	handler := cfg.requireRole(callerID, database.RoleAdmin)
+	for _, tt := range tests {
+		token, err := auth.IssueJWT(42, tt.roles, cfg.jwtKeys)
+		if err != nil {
+			t.Fatalf("IssueJWT: %s", err)
+		}
+		if w := serve(handler, "Bearer "+token); w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+	}
+
+	// roles are checked after the caller is authenticated
+	w := serve(handler, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no token: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestRequireAuthAccessTokens(t *testing.T) {
+	cfg := newMiddlewareConfig(t)
+
+	user, err := cfg.db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	admin, err := cfg.db.CreateUser("admin@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	_, err = cfg.db.SetUserRoles(admin.ID, []string{database.RoleUser, database.RoleAdmin})
+	if err != nil {
+		t.Fatalf("SetUserRoles: %s", err)
+	}
+
+	createToken := func(userID int, scopes []string, expiresAt *time.Time) (database.AccessToken, string) {
+		token, err := auth.GenerateAccessToken()
+		if err != nil {
+			t.Fatalf("GenerateAccessToken: %s", err)
+		}
+		accessToken, err := cfg.db.CreateAccessToken(userID, "bot", token, scopes, expiresAt)
+		if err != nil {
+			t.Fatalf("CreateAccessToken: %s", err)
+		}
+		return accessToken, "Bearer " + token
+	}
+
+	_, read := createToken(user.ID, []string{auth.ScopeChirpsRead}, nil)
+	_, write := createToken(user.ID, []string{auth.ScopeChirpsRead, auth.ScopeChirpsWrite}, nil)
+	revokedToken, revoked := createToken(user.ID, []string{auth.ScopeChirpsWrite}, nil)
+	err = cfg.db.RevokeAccessToken(revokedToken.ID, user.ID)
+	if err != nil {
+		t.Fatalf("RevokeAccessToken: %s", err)
+	}
+	lapsed := time.Now().Add(-time.Minute)
+	_, expired := createToken(user.ID, []string{auth.ScopeChirpsWrite}, &lapsed)
+	_, userAdmin := createToken(user.ID, []string{auth.ScopeAdmin}, nil)
+	_, adminAdmin := createToken(admin.ID, []string{auth.ScopeAdmin}, nil)
+	_, adminWrite := createToken(admin.ID, []string{auth.ScopeChirpsWrite}, nil)
+	unknown, err := auth.GenerateAccessToken()
+	if err != nil {
+		t.Fatalf("GenerateAccessToken: %s", err)
+	}
+
+	const invalidToken = `Bearer realm="chirpy", error="invalid_token"`
+	tests := []struct {
+		name          string
+		handler       http.Handler
+		authorization string
+		wantStatus    int
+		wantChallenge string
+	}{
+		{name: "scope granted", handler: cfg.requireAuth(callerID, auth.ScopeChirpsWrite), authorization: write, wantStatus: http.StatusOK},
+		{name: "scope missing", handler: cfg.requireAuth(callerID, auth.ScopeChirpsWrite), authorization: read, wantStatus: http.StatusForbidden,
+			wantChallenge: `Bearer realm="chirpy", error="insufficient_scope", scope="chirps:write"`},
+		// a route that lists no scopes only takes tokens from a login
+		{name: "route without scopes", handler: cfg.requireAuth(callerID), authorization: write, wantStatus: http.StatusForbidden,
+			wantChallenge: `Bearer realm="chirpy", error="insufficient_scope"`},
+		{name: "revoked", handler: cfg.requireAuth(callerID, auth.ScopeChirpsWrite), authorization: revoked, wantStatus: http.StatusUnauthorized, wantChallenge: invalidToken},
+		{name: "expired", handler: cfg.requireAuth(callerID, auth.ScopeChirpsWrite), authorization: expired, wantStatus: http.StatusUnauthorized, wantChallenge: invalidToken},
+		{name: "unknown", handler: cfg.requireAuth(callerID, auth.ScopeChirpsWrite), authorization: "Bearer " + unknown, wantStatus: http.StatusUnauthorized, wantChallenge: invalidToken},
+		// the admin scope only goes as far as the user's roles
+		{name: "admin scope of an admin", handler: cfg.requireRole(callerID, database.RoleAdmin), authorization: adminAdmin, wantStatus: http.StatusOK},
+		{name: "admin scope of a user", handler: cfg.requireRole(callerID, database.RoleAdmin), authorization: userAdmin, wantStatus: http.StatusForbidden},
+		{name: "admin without the admin scope", handler: cfg.requireRole(callerID, database.RoleAdmin), authorization: adminWrite, wantStatus: http.StatusForbidden,
+			wantChallenge: `Bearer realm="chirpy", error="insufficient_scope", scope="admin"`},
+	}
+
+	for _, tt := range tests {
+		w := serve(tt.handler, tt.authorization)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+			continue
+		}
+		if got := w.Header().Get("WWW-Authenticate"); got != tt.wantChallenge {
+			t.Errorf("%s: WWW-Authenticate = %q, want %q", tt.name, got, tt.wantChallenge)
+		}
+	}
+}
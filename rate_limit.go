@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows each user a number of actions within a sliding
+// window. It lives in memory, a restart gives everyone a clean slate.
+type rateLimiter struct {
+	mux    sync.Mutex
+	window time.Duration
+	// actions holds when each user's actions in the window happened,
+	// oldest first
+	actions map[int][]time.Time
+}
+
+func newRateLimiter(window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		window:  window,
+		actions: make(map[int][]time.Time),
+	}
+}
+
+// allow records an action of userID at now if they did fewer than
+// limit within the window, otherwise it returns how long until they
+// can. A limit of 0 or less allows everything.
+func (l *rateLimiter) allow(userID, limit int, now time.Time) (time.Duration, bool) {
+	if limit <= 0 {
+		return 0, true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	actions := l.recent(userID, now)
+	if len(actions) >= limit {
+		return actions[len(actions)-limit].Add(l.window).Sub(now), false
+	}
+
+	l.actions[userID] = append(actions, now)
+
+	// keep the map from growing with users that went quiet
+	if len(l.actions) > 10000 {
+		for id := range l.actions {
+			l.recent(id, now)
+		}
+	}
+
+	return 0, true
+}
+
+// recent drops the actions of userID that left the window and returns
+// the rest. The caller must hold the lock.
+func (l *rateLimiter) recent(userID int, now time.Time) []time.Time {
+	actions := l.actions[userID]
+
+	i := 0
+	for i < len(actions) && !actions[i].After(now.Add(-l.window)) {
+		i++
+	}
+	actions = actions[i:]
+
+	if len(actions) == 0 {
+		delete(l.actions, userID)
+	} else {
+		l.actions[userID] = actions
+	}
+	return actions
+}
+
+// respondRateLimited answers 429, telling the client when to retry
+func respondRateLimited(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	respondWithError(w, http.StatusTooManyRequests, msg)
+}
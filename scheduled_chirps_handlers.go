@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+// scheduledChirpsInterval is how often due scheduled chirps are published
+const scheduledChirpsInterval = 10 * time.Second
+
+func (cfg *apiConfig) listScheduledChirps(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	scheduled, err := cfg.db.ListScheduledChirps(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, scheduled)
+}
+
+func (cfg *apiConfig) cancelScheduledChirp(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("scheduledID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.db.CancelScheduledChirp(id, caller.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// publishScheduledChirps publishes the scheduled chirps that are due.
+// They were allowed when scheduled, so they're published even if
+// their author lost Chirpy Red since.
+func (cfg *apiConfig) publishScheduledChirps(now time.Time) {
+	published, err := cfg.db.PublishDueChirps(now)
+	if err != nil {
+		log.Printf("Error publishing scheduled chirps: %s", err)
+	}
+	if len(published) > 0 {
+		log.Printf("published %d scheduled chirps", len(published))
+	}
+}
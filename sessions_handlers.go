@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+// sessionPurgeInterval is how often expired sessions and refresh
+// tokens are deleted
+const sessionPurgeInterval = time.Hour
+
+func (cfg *apiConfig) listSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	sessions, err := cfg.db.ListSessions(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (cfg *apiConfig) revokeSession(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	id, err := strconv.Atoi(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	err = cfg.db.RevokeSession(id, caller.UserID)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	err := cfg.db.RevokeAllSessions(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+// purgeExpiredSessions deletes the sessions and refresh tokens that
+// expired, which are kept until then to tell a replay from a stranger
+func (cfg *apiConfig) purgeExpiredSessions(now time.Time) {
+	n, err := cfg.db.PurgeExpiredSessions(now)
+	if err != nil {
+		log.Printf("Error purging expired sessions: %s", err)
+	} else if n > 0 {
+		log.Printf("purged %d expired sessions and refresh tokens", n)
+	}
+}
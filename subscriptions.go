@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const (
+	// defaultSubscriptionGrace is how long a subscription whose payment
+	// failed is kept, unless CHIRPY_RED_GRACE_PERIOD says otherwise
+	defaultSubscriptionGrace = 7 * 24 * time.Hour
+
+	// subscriptionExpiryInterval is how often lapsed subscriptions are expired
+	subscriptionExpiryInterval = time.Minute
+)
+
+// errSubscriptionUnchanged is returned by applyPolkaEvent for
+// events that don't apply to the subscription
+var errSubscriptionUnchanged = errors.New("subscription unchanged")
+
+// errStalePolkaEvent is returned by applyPolkaEvent for events that
+// happened before the last one applied to the subscription
+var errStalePolkaEvent = errors.New("a later event was applied already")
+
+// polkaEvents are the events applyPolkaEvent understands
+var polkaEvents = []string{
+	"user.upgraded",
+	"subscription.renewed",
+	"payment.failed",
+	"subscription.cancelled",
+	"user.downgraded",
+}
+
+type polkaData struct {
+	UserID int    `json:"user_id,omitempty"`
+	Plan   string `json:"plan,omitempty"`
+	// CurrentPeriodEnd is when the paid period ends, one subscription
+	// period after the event when Polka leaves it out
+	CurrentPeriodEnd *time.Time `json:"current_period_end,omitempty"`
+}
+
+// applyPolkaEvent moves sub through its lifecycle according to a Polka
+// event that happened at, unless a later event was applied already
+func (cfg *apiConfig) applyPolkaEvent(sub *database.Subscription, event string, data polkaData, at time.Time) error {
+	// a retried event mustn't undo what happened after it
+	if sub.EventAt != nil && at.Before(*sub.EventAt) {
+		return errStalePolkaEvent
+	}
+
+	periodEnd := func(from time.Time) time.Time {
+		if data.CurrentPeriodEnd != nil {
+			return data.CurrentPeriodEnd.UTC()
+		}
+		return from.Add(database.SubscriptionPeriod).UTC()
+	}
+
+	switch event {
+	case "user.upgraded":
+		sub.Plan = database.PlanChirpyRed
+		if data.Plan != "" {
+			sub.Plan = data.Plan
+		}
+		sub.Status = database.SubscriptionActive
+		sub.CurrentPeriodEnd = periodEnd(at)
+		sub.GracePeriodEnd = nil
+	case "subscription.renewed":
+		if sub.Status == "" {
+			return errSubscriptionUnchanged
+		}
+		if data.Plan != "" {
+			sub.Plan = data.Plan
+		}
+		// a renewal before the period ended extends it
+		sub.Status = database.SubscriptionActive
+		sub.CurrentPeriodEnd = periodEnd(latest(sub.CurrentPeriodEnd, at))
+		sub.GracePeriodEnd = nil
+	case "payment.failed":
+		if sub.Status != database.SubscriptionActive && sub.Status != database.SubscriptionPastDue {
+			return errSubscriptionUnchanged
+		}
+		if sub.Status == database.SubscriptionActive {
+			graceEnd := latest(sub.CurrentPeriodEnd, at).Add(cfg.subscriptionGrace).UTC()
+			sub.GracePeriodEnd = &graceEnd
+		}
+		sub.Status = database.SubscriptionPastDue
+	case "subscription.cancelled":
+		if sub.Status == "" || sub.Status == database.SubscriptionExpired {
+			return errSubscriptionUnchanged
+		}
+		// what was paid for is kept until the period ends
+		sub.Status = database.SubscriptionCancelled
+		sub.GracePeriodEnd = nil
+	case "user.downgraded":
+		if sub.Status == "" || sub.Status == database.SubscriptionExpired {
+			return errSubscriptionUnchanged
+		}
+		sub.Status = database.SubscriptionExpired
+		sub.GracePeriodEnd = nil
+	default:
+		return errSubscriptionUnchanged
+	}
+
+	eventAt := at.UTC()
+	sub.EventAt = &eventAt
+	return nil
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// expireSubscriptions marks lapsed subscriptions as expired. Whether
+// a user has Chirpy Red doesn't wait for it, this only keeps the stored
+// status truthful.
+func (cfg *apiConfig) expireSubscriptions(now time.Time) {
+	n, err := cfg.db.ExpireSubscriptions(now)
+	if err != nil {
+		log.Printf("Error expiring subscriptions: %s", err)
+	} else if n > 0 {
+		log.Printf("expired %d subscriptions", n)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+func TestApplyPolkaEvent(t *testing.T) {
+	const (
+		day    = 24 * time.Hour
+		period = database.SubscriptionPeriod
+		grace  = 3 * day
+	)
+	cfg := &apiConfig{subscriptionGrace: grace}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// after returns the time d after start
+	after := func(d time.Duration) time.Time { return start.Add(d) }
+	explicitEnd := after(90 * day)
+
+	type step struct {
+		event string
+		data  polkaData
+		at    time.Duration
+		// wantErr is what applying the event returns
+		wantErr error
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		// wantStatus, wantPeriodEnd and wantGraceEnd describe the
+		// subscription after every step, wantGraceEnd is 0 for none
+		wantStatus    string
+		wantPeriodEnd time.Time
+		wantGraceEnd  time.Duration
+		// activeUntil is when the subscription stops giving access
+		activeUntil time.Duration
+	}{
+		{
+			name:          "upgrade",
+			steps:         []step{{event: "user.upgraded"}},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(period),
+			activeUntil:   period,
+		},
+		{
+			name:          "upgrade with the end of the period",
+			steps:         []step{{event: "user.upgraded", data: polkaData{CurrentPeriodEnd: &explicitEnd}}},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: explicitEnd,
+			activeUntil:   90 * day,
+		},
+		{
+			name: "renewal before the period ends extends it",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "subscription.renewed", at: period - day},
+			},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(2 * period),
+			activeUntil:   2 * period,
+		},
+		{
+			name: "renewal after the period ended starts a new one",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "subscription.renewed", at: period + day},
+			},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(2*period + day),
+			activeUntil:   2*period + day,
+		},
+		{
+			name: "payment failure starts the grace period",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "payment.failed", at: period - day},
+			},
+			wantStatus:    database.SubscriptionPastDue,
+			wantPeriodEnd: after(period),
+			wantGraceEnd:  period + grace,
+			activeUntil:   period + grace,
+		},
+		{
+			name: "payment failure after the period ended",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "payment.failed", at: period + day},
+			},
+			wantStatus:    database.SubscriptionPastDue,
+			wantPeriodEnd: after(period),
+			wantGraceEnd:  period + day + grace,
+			activeUntil:   period + day + grace,
+		},
+		{
+			name: "another payment failure keeps the grace period",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "payment.failed", at: period - day},
+				{event: "payment.failed", at: period + day},
+			},
+			wantStatus:    database.SubscriptionPastDue,
+			wantPeriodEnd: after(period),
+			wantGraceEnd:  period + grace,
+			activeUntil:   period + grace,
+		},
+		{
+			name: "renewal during the grace period",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "payment.failed", at: period - day},
+				{event: "subscription.renewed", at: period + day},
+			},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(2*period + day),
+			activeUntil:   2*period + day,
+		},
+		{
+			name: "cancelled during the grace period",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "payment.failed", at: period - day},
+				{event: "subscription.cancelled", at: period + day},
+			},
+			wantStatus:    database.SubscriptionCancelled,
+			wantPeriodEnd: after(period),
+			activeUntil:   period,
+		},
+		{
+			name: "cancelled keeps the paid period",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "subscription.cancelled", at: day},
+				{event: "payment.failed", at: 2 * day, wantErr: errSubscriptionUnchanged},
+			},
+			wantStatus:    database.SubscriptionCancelled,
+			wantPeriodEnd: after(period),
+			activeUntil:   period,
+		},
+		{
+			name: "renewal of a cancelled subscription",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "subscription.cancelled", at: day},
+				{event: "subscription.renewed", at: period},
+			},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(2 * period),
+			activeUntil:   2 * period,
+		},
+		{
+			name: "downgrade ends it at once",
+			steps: []step{
+				{event: "user.upgraded"},
+				{event: "user.downgraded", at: day},
+				{event: "subscription.cancelled", at: 2 * day, wantErr: errSubscriptionUnchanged},
+				{event: "user.downgraded", at: 2 * day, wantErr: errSubscriptionUnchanged},
+			},
+			wantStatus:    database.SubscriptionExpired,
+			wantPeriodEnd: after(period),
+			activeUntil:   0,
+		},
+		{
+			name: "events without a subscription",
+			steps: []step{
+				{event: "subscription.renewed", wantErr: errSubscriptionUnchanged},
+				{event: "payment.failed", wantErr: errSubscriptionUnchanged},
+				{event: "subscription.cancelled", wantErr: errSubscriptionUnchanged},
+				{event: "user.downgraded", wantErr: errSubscriptionUnchanged},
+				{event: "user.refunded", wantErr: errSubscriptionUnchanged},
+			},
+			activeUntil: 0,
+		},
+		{
+			name: "stale event",
+			steps: []step{
+				{event: "user.upgraded", at: day},
+				{event: "user.downgraded", at: 0, wantErr: errStalePolkaEvent},
+			},
+			wantStatus:    database.SubscriptionActive,
+			wantPeriodEnd: after(period + day),
+			activeUntil:   period + day,
+		},
+	}
+
+	for _, tt := range tests {
+		var sub database.Subscription
+		for _, s := range tt.steps {
+			// a failed change isn't committed, like in UpdateSubscription
+			changed := sub
+			err := cfg.applyPolkaEvent(&changed, s.event, s.data, after(s.at))
+			if !errors.Is(err, s.wantErr) {
+				t.Errorf("%s: applying %s: err = %v, want %v", tt.name, s.event, err, s.wantErr)
+			}
+			if err == nil {
+				sub = changed
+			}
+		}
+
+		if sub.Status != tt.wantStatus {
+			t.Errorf("%s: status = %q, want %q", tt.name, sub.Status, tt.wantStatus)
+		}
+		if !sub.CurrentPeriodEnd.Equal(tt.wantPeriodEnd) {
+			t.Errorf("%s: current period end = %s, want %s", tt.name, sub.CurrentPeriodEnd, tt.wantPeriodEnd)
+		}
+		switch {
+		case tt.wantGraceEnd == 0 && sub.GracePeriodEnd != nil:
+			t.Errorf("%s: grace period end = %s, want none", tt.name, sub.GracePeriodEnd)
+		case tt.wantGraceEnd != 0 && (sub.GracePeriodEnd == nil || !sub.GracePeriodEnd.Equal(after(tt.wantGraceEnd))):
+			t.Errorf("%s: grace period end = %v, want %s", tt.name, sub.GracePeriodEnd, after(tt.wantGraceEnd))
+		}
+
+		last := tt.steps[len(tt.steps)-1].at
+		if tt.activeUntil > 0 && !sub.Active(after(tt.activeUntil-time.Second)) {
+			t.Errorf("%s: inactive just before %s", tt.name, after(tt.activeUntil))
+		}
+		if sub.Active(after(max(tt.activeUntil, last))) {
+			t.Errorf("%s: still active at %s", tt.name, after(max(tt.activeUntil, last)))
+		}
+	}
+}
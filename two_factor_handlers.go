@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const (
+	totpIssuer        = "Chirpy"
+	recoveryCodeCount = 10
+)
+
+type challengeDto struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+}
+
+type enrollTOTPDto struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type secondFactorReq struct {
+	ChallengeToken string `json:"challenge_token,omitempty"`
+	Code           string `json:"code,omitempty"`
+	RecoveryCode   string `json:"recovery_code,omitempty"`
+}
+
+type recoveryCodesDto struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (cfg *apiConfig) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	err = cfg.db.SetTOTPSecret(dbUser.ID, secret)
+	if err != nil {
+		if errors.Is(err, database.ErrAlreadyExists) {
+			respondWithError(w, http.StatusConflict, "two-factor authentication is already enabled")
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := enrollTOTPDto{
+		Secret:     secret,
+		OTPAuthURI: auth.TOTPURI(secret, dbUser.Email, totpIssuer),
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	var req secondFactorReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if dbUser.TOTPEnabled {
+		respondWithError(w, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+	if dbUser.TOTPSecret == "" {
+		respondWithError(w, http.StatusBadRequest, "enroll first")
+		return
+	}
+
+	step, err := auth.ValidateTOTP(dbUser.TOTPSecret, req.Code, time.Now())
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, auth.ErrInvalidTOTP.Error())
+		return
+	}
+
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, auth.HashRecoveryCode(code))
+	}
+
+	err = cfg.db.EnableTOTP(dbUser.ID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	// like the secret, the codes are only ever shown once
+	respondWithJSON(w, http.StatusOK, recoveryCodesDto{RecoveryCodes: codes})
+}
+
+func (cfg *apiConfig) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
+	var req secondFactorReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(caller.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !dbUser.TOTPEnabled {
+		respondWithError(w, http.StatusBadRequest, "two-factor authentication isn't enabled")
+		return
+	}
+
+	err = cfg.checkSecondFactor(dbUser, req)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, auth.ErrInvalidTOTP.Error())
+		return
+	}
+
+	err = cfg.db.DisableTOTP(dbUser.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, nil)
+}
+
+func (cfg *apiConfig) loginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorReq
+
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&req)
+	if err != nil {
+		log.Printf("Error decoding body: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	userID, err := auth.ValidateActionToken(req.ChallengeToken, auth.PurposeTwoFactor, cfg.jwtKeys, nil)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired challenge")
+		return
+	}
+
+	dbUser, err := cfg.db.GetUserByID(userID)
+	if err != nil || !dbUser.TOTPEnabled {
+		respondWithError(w, http.StatusUnauthorized, "invalid or expired challenge")
+		return
+	}
+
+	// codes are guessed more easily than passwords,
+	// so failures count toward the same lockout
+	if !cfg.reserveLogin(w, r, dbUser.Email) || !cfg.checkAccountLock(w, r, dbUser) {
+		return
+	}
+
+	err = cfg.checkSecondFactor(dbUser, req)
+	if err != nil {
+		cfg.loginFailed(r, dbUser)
+		respondWithError(w, http.StatusUnauthorized, auth.ErrInvalidTOTP.Error())
+		return
+	}
+	cfg.releaseLogin(r, dbUser.Email)
+
+	cfg.completeLogin(w, r, dbUser)
+}
+
+// checkSecondFactor accepts either a TOTP code that wasn't used
+// before or an unused recovery code, which is then spent
+func (cfg *apiConfig) checkSecondFactor(dbUser database.User, req secondFactorReq) error {
+	if req.RecoveryCode != "" {
+		return cfg.db.UseRecoveryCode(dbUser.ID, auth.HashRecoveryCode(req.RecoveryCode))
+	}
+
+	step, err := auth.ValidateTOTP(dbUser.TOTPSecret, req.Code, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return cfg.db.UseTOTPStep(dbUser.ID, step)
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
+	"net/mail"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
 )
 
 type loginReq struct {
@@ -17,16 +18,28 @@ type loginReq struct {
 }
 
 type tokenDto struct {
-	Token string `json:"token,omitempty"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
 }
 
 type userDto struct {
-	Email        *string `json:"email,omitempty"`
-	Password     *string `json:"password,omitempty"`
-	Token        string  `json:"token,omitempty"`
-	RefreshToken string  `json:"refresh_token,omitempty"`
-	ID           int     `json:"id,omitempty"`
-	IsChirpyRed  bool    `json:"is_chirpy_red"`
+	CreatedAt     *time.Time `json:"created_at,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+	Email         *string    `json:"email,omitempty"`
+	Password      *string    `json:"password,omitempty"`
+	Roles         []string   `json:"roles,omitempty"`
+	Token         string     `json:"token,omitempty"`
+	RefreshToken  string     `json:"refresh_token,omitempty"`
+	ID            int        `json:"id,omitempty"`
+	IsChirpyRed   bool       `json:"is_chirpy_red"`
+	EmailVerified bool       `json:"email_verified"`
+}
+
+// validEmail reports whether email is a bare address, without a
+// display name or anything else net/mail would strip from it
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
 }
 
 func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
@@ -46,23 +59,51 @@ func (cfg *apiConfig) createUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pass, err := auth.GenerateHashedPass(*user.Password)
+	if !validEmail(*user.Email) {
+		respondWithError(w, http.StatusBadRequest, "invalid email address")
+		return
+	}
+
+	err = cfg.passwordPolicy.Check(*user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	dbUser, err := cfg.db.CreateUser(*user.Email, string(pass))
+	pass, err := cfg.passwords.Hash(*user.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	dbUser, err := cfg.db.CreateUser(*user.Email, pass)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, "email already in use")
+		return
+	}
+	if err != nil {
+		log.Printf("Error creating user: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	msg, err := cfg.verificationMessage(dbUser)
+	if err != nil {
+		log.Printf("Error issuing verification token: %s", err)
+	} else {
+		cfg.sendMailLater(msg)
+	}
+
 	response := userDto{
-		ID:          dbUser.ID,
-		Email:       &dbUser.Email,
-		Password:    nil,
-		IsChirpyRed: dbUser.IsChirpyRed,
+		ID:            dbUser.ID,
+		CreatedAt:     &dbUser.CreatedAt,
+		UpdatedAt:     &dbUser.UpdatedAt,
+		Email:         &dbUser.Email,
+		Password:      nil,
+		Roles:         dbUser.Roles,
+		IsChirpyRed:   dbUser.IsChirpyRed(),
+		EmailVerified: dbUser.EmailVerified,
 	}
 	respondWithJSON(w, http.StatusCreated, response)
 }
@@ -84,80 +125,130 @@ func (cfg *apiConfig) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	dbUser, err := cfg.db.GetUser(*req.Email)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if !cfg.reserveLogin(w, r, *req.Email) {
 		return
 	}
 
-	err = auth.ValidateToken([]byte(dbUser.Password), []byte(*req.Password))
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, err.Error())
+	dbUser, err := cfg.db.GetUser(*req.Email)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Error getting user: %s", err)
+
+		cfg.releaseLogin(r, *req.Email)
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
 		return
 	}
-
-	signedToken, err := auth.IssueJWT(dbUser.ID, cfg.jwtSecret)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if dbUser.ID != 0 && !cfg.checkAccountLock(w, r, dbUser) {
 		return
 	}
 
-	refreshToken, err := auth.GenerateRefreshToken()
+	// an unknown email gets the same answer as a wrong password,
+	// in the same time, so neither tells whether the account exists
+	var needsRehash bool
+	if dbUser.ID == 0 {
+		cfg.passwords.VerifyDummy(*req.Password)
+		err = database.ErrNotFound
+	} else {
+		needsRehash, err = cfg.passwords.Verify(dbUser.Password, *req.Password)
+	}
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		if !errors.Is(err, auth.ErrPasswordMismatch) && !errors.Is(err, database.ErrNotFound) {
+			log.Printf("Error verifying password of user %d: %s", dbUser.ID, err)
+		}
+		cfg.loginFailed(r, dbUser)
+		respondWithError(w, http.StatusUnauthorized, errBadCredentials)
 		return
 	}
+	cfg.releaseLogin(r, *req.Email)
 
-	refreshTokenDb, err := cfg.db.UpdateUserRefreshToken(dbUser.ID, refreshToken.Token, refreshToken.TokenExpDate)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+	if needsRehash {
+		cfg.rehashPassword(dbUser, *req.Password)
 	}
 
-	response := userDto{
-		ID:           dbUser.ID,
-		Email:        &dbUser.Email,
-		Password:     nil,
-		IsChirpyRed:  dbUser.IsChirpyRed,
-		Token:        signedToken,
-		RefreshToken: refreshTokenDb.RefreshToken,
+	if dbUser.TOTPEnabled {
+		challengeToken, err := auth.IssueActionToken(dbUser.ID, auth.PurposeTwoFactor, "", auth.ChallengeExpiration, cfg.jwtKeys)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, challengeDto{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken,
+		})
+		return
 	}
 
-	respondWithJSON(w, http.StatusOK, response)
+	cfg.completeLogin(w, r, dbUser)
 }
 
-func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
-	authReqHeader := r.Header.Get("Authorization")
-
-	if authReqHeader == "" {
-		w.WriteHeader(http.StatusBadRequest)
+// rehashPassword upgrades the hash of a password that was just
+// verified to the configured algorithm and parameters. It's best
+// effort, the old hash keeps working if it fails.
+func (cfg *apiConfig) rehashPassword(dbUser database.User, password string) {
+	hash, err := cfg.passwords.Hash(password)
+	if err != nil {
+		log.Printf("Error rehashing password of user %d: %s", dbUser.ID, err)
 		return
 	}
 
-	tokenStr := strings.Split(authReqHeader, " ")[1]
+	err = cfg.db.RehashPassword(dbUser.ID, dbUser.Password, hash)
+	if err != nil && !errors.Is(err, database.ErrNotFound) {
+		log.Printf("Error rehashing password of user %d: %s", dbUser.ID, err)
+	}
+}
 
-	token, err := auth.ValidateJWTToken(tokenStr, cfg.jwtSecret)
+// completeLogin starts a session for a user whose credentials were
+// all checked and responds with its tokens
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, dbUser database.User) {
+	signedToken, err := auth.IssueJWT(dbUser.ID, dbUser.Roles, cfg.jwtKeys)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Invalid token")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	claims, ok := token.Claims.(*jwt.RegisteredClaims)
-	if !ok {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't parse claims")
+	refreshToken, err := auth.GenerateRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	userID, err := claims.GetSubject()
+	_, _, err = cfg.db.CreateSession(dbUser.ID, r.UserAgent(), clientIP(r), refreshToken.Token, refreshToken.TokenExpDate)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	cfg.loginEmails.reset(emailKey(dbUser.Email))
+	if dbUser.FailedLogins > 0 {
+		err = cfg.db.ResetLoginFailures(dbUser.ID)
+		if err != nil {
+			log.Printf("Error resetting failed logins of user %d: %s", dbUser.ID, err)
+		}
+	}
+
+	response := userDto{
+		ID:            dbUser.ID,
+		CreatedAt:     &dbUser.CreatedAt,
+		UpdatedAt:     &dbUser.UpdatedAt,
+		Email:         &dbUser.Email,
+		Password:      nil,
+		Roles:         dbUser.Roles,
+		IsChirpyRed:   dbUser.IsChirpyRed(),
+		EmailVerified: dbUser.EmailVerified,
+		Token:         signedToken,
+		RefreshToken:  refreshToken.Token,
+	}
+
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
+	caller, _ := principalFromContext(r.Context())
+
 	var user userDto
 
 	decoder := json.NewDecoder(r.Body)
-	err = decoder.Decode(&user)
+	err := decoder.Decode(&user)
 	if err != nil {
 		log.Printf("Error decoding body: %s", err)
 
@@ -170,30 +261,54 @@ func (cfg *apiConfig) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	pass, err := auth.GenerateHashedPass(*user.Password)
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if !validEmail(*user.Email) {
+		respondWithError(w, http.StatusBadRequest, "invalid email address")
 		return
 	}
 
-	// userID to int
-	userIDInt, err := strconv.Atoi(userID)
+	err = cfg.passwordPolicy.Check(*user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	updatedUser, err := cfg.db.UpdateUser(userIDInt, *user.Email, string(pass))
+	pass, err := cfg.passwords.Hash(*user.Password)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	updatedUser, err := cfg.db.UpdateUser(caller.UserID, *user.Email, pass)
+	if errors.Is(err, database.ErrAlreadyExists) {
+		respondWithError(w, http.StatusConflict, "email already in use")
+		return
+	}
+	if err != nil {
+		log.Printf("Error updating user: %s", err)
+
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		return
+	}
+
+	// a changed email, like one never verified, needs verifying
+	if !updatedUser.EmailVerified {
+		msg, err := cfg.verificationMessage(updatedUser)
+		if err != nil {
+			log.Printf("Error issuing verification token: %s", err)
+		} else {
+			cfg.sendMailLater(msg)
+		}
+	}
+
 	response := userDto{
-		ID:          updatedUser.ID,
-		Email:       &updatedUser.Email,
-		IsChirpyRed: updatedUser.IsChirpyRed,
-		Password:    nil,
+		ID:            updatedUser.ID,
+		CreatedAt:     &updatedUser.CreatedAt,
+		UpdatedAt:     &updatedUser.UpdatedAt,
+		Email:         &updatedUser.Email,
+		Roles:         updatedUser.Roles,
+		IsChirpyRed:   updatedUser.IsChirpyRed(),
+		EmailVerified: updatedUser.EmailVerified,
+		Password:      nil,
 	}
 	respondWithJSON(w, http.StatusOK, response)
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+	"github.com/luispinto23/chirpy-new/internal/mail"
+)
+
+func TestEmailAlreadyInUse(t *testing.T) {
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	passwords, err := auth.NewPasswordHasher(auth.HashBcrypt, 4, auth.DefaultArgon2Params)
+	if err != nil {
+		t.Fatalf("NewPasswordHasher: %s", err)
+	}
+	policy, err := auth.NewPasswordPolicy(8, 72, "")
+	if err != nil {
+		t.Fatalf("NewPasswordPolicy: %s", err)
+	}
+	cfg := &apiConfig{
+		db:             db,
+		jwtKeys:        auth.NewHMACKeySet("secret"),
+		mailer:         mail.NewLogMailer(io.Discard, "no-reply@localhost"),
+		passwords:      passwords,
+		passwordPolicy: policy,
+	}
+	// the verification mails are sent in the background
+	t.Cleanup(cfg.jobs.Wait)
+
+	body := func(email string) io.Reader {
+		return strings.NewReader(`{"email":"` + email + `","password":"a password"}`)
+	}
+	create := func(email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		cfg.createUser(w, httptest.NewRequest(http.MethodPost, "/api/users", body(email)))
+		return w
+	}
+
+	if w := create("a@b.com"); w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if w := create("b@b.com"); w.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+	other, err := db.GetUser("b@b.com")
+	if err != nil {
+		t.Fatalf("GetUser: %s", err)
+	}
+
+	w := create("a@b.com")
+	if w.Code != http.StatusConflict {
+		t.Errorf("create with a taken email: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if !strings.Contains(w.Body.String(), "email already in use") {
+		t.Errorf("create with a taken email: body = %s", w.Body)
+	}
+
+	r := httptest.NewRequest(http.MethodPut, "/api/users", body("a@b.com"))
+	r = r.WithContext(context.WithValue(r.Context(), principalKey, principal{UserID: other.ID}))
+	w = httptest.NewRecorder()
+	cfg.updateUser(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("update to a taken email: status = %d, want %d", w.Code, http.StatusConflict)
+	}
+	if !strings.Contains(w.Body.String(), "email already in use") {
+		t.Errorf("update to a taken email: body = %s", w.Body)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const (
+	defaultWebhookEventsLimit = 50
+	maxWebhookEventsLimit     = 500
+)
+
+var webhookStatuses = []string{
+	database.WebhookPending,
+	database.WebhookProcessed,
+	database.WebhookIgnored,
+	database.WebhookFailed,
+}
+
+type webhookEventDto struct {
+	ID            int        `json:"id"`
+	Source        string     `json:"source"`
+	DeliveryID    string     `json:"delivery_id,omitempty"`
+	Event         string     `json:"event,omitempty"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	ReceivedAt    time.Time  `json:"received_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	ProcessedAt   *time.Time `json:"processed_at,omitempty"`
+	// Payload is only shown when inspecting a single event
+	Payload any `json:"payload,omitempty"`
+}
+
+func toWebhookEventDto(webhookEvent database.WebhookEvent) webhookEventDto {
+	return webhookEventDto{
+		ID:            webhookEvent.ID,
+		Source:        webhookEvent.Source,
+		DeliveryID:    webhookEvent.DeliveryID,
+		Event:         webhookEvent.Event,
+		Status:        webhookEvent.Status,
+		Attempts:      webhookEvent.Attempts,
+		LastError:     webhookEvent.LastError,
+		ReceivedAt:    webhookEvent.ReceivedAt,
+		NextAttemptAt: webhookEvent.NextAttemptAt,
+		ProcessedAt:   webhookEvent.ProcessedAt,
+	}
+}
+
+// withPayload adds the payload of webhookEvent to its dto, as JSON
+// when it is and as a string when it isn't
+func withPayload(dto webhookEventDto, webhookEvent database.WebhookEvent) webhookEventDto {
+	switch {
+	case webhookEvent.Payload == "":
+	case json.Valid([]byte(webhookEvent.Payload)):
+		dto.Payload = json.RawMessage(webhookEvent.Payload)
+	default:
+		dto.Payload = webhookEvent.Payload
+	}
+	return dto
+}
+
+func (cfg *apiConfig) listWebhookEvents(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	status := query.Get("status")
+	if status != "" && !slices.Contains(webhookStatuses, status) {
+		respondWithError(w, http.StatusBadRequest, "unknown status "+strconv.Quote(status))
+		return
+	}
+
+	limit := defaultWebhookEventsLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxWebhookEventsLimit {
+			respondWithError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxWebhookEventsLimit))
+			return
+		}
+	}
+
+	webhookEvents, err := cfg.db.ListWebhookEvents(status, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := make([]webhookEventDto, 0, len(webhookEvents))
+	for _, webhookEvent := range webhookEvents {
+		response = append(response, toWebhookEventDto(webhookEvent))
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+func (cfg *apiConfig) getWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	webhookEvent, err := cfg.db.GetWebhookEvent(id)
+	if err != nil {
+		if errors.Is(err, database.ErrNotFound) {
+			respondWithError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, withPayload(toWebhookEventDto(webhookEvent), webhookEvent))
+}
+
+// replayWebhookEvent processes an event again right away. Applying a
+// billing event twice isn't harmless, so processed events are refused,
+// and so are those being processed.
+func (cfg *apiConfig) replayWebhookEvent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("eventID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	now := time.Now()
+	webhookEvent, err := cfg.db.ClaimWebhookEvent(id, now, now.Add(webhookClaim))
+	if err != nil {
+		switch {
+		case errors.Is(err, database.ErrNotFound):
+			respondWithError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, database.ErrWebhookProcessed), errors.Is(err, database.ErrWebhookClaimed):
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	// how the attempt went is in the event
+	webhookEvent, _ = cfg.processWebhookEvent(webhookEvent, now)
+
+	respondWithJSON(w, http.StatusOK, withPayload(toWebhookEventDto(webhookEvent), webhookEvent))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+const (
+	// webhookClaim is how long whoever processes a webhook event has
+	// before the retry job takes it over
+	webhookClaim = time.Minute
+
+	// webhookMaxAttempts is how many times an event is tried before
+	// it's left failed for an admin to replay
+	webhookMaxAttempts = 10
+
+	// webhookRetryInterval is how often due webhook events are retried
+	// and webhookRetryBatch how many at most per run
+	webhookRetryInterval = 10 * time.Second
+	webhookRetryBatch    = 50
+
+	// webhookRetention is how long webhook events are kept once they're
+	// done with, and webhookPurgeInterval how often older ones are purged.
+	// A redelivery of a purged event would be applied again, which is
+	// why it's far longer than Polka keeps redelivering.
+	webhookRetention     = 30 * 24 * time.Hour
+	webhookPurgeInterval = time.Hour
+)
+
+// webhookBackoff doubles the wait between the attempts of an event,
+// starting at a minute, so retries span about four hours
+var webhookBackoff = backoff{base: 30 * time.Second, max: time.Hour}
+
+// errUnknownWebhookSource is the error of events no handler applies
+var errUnknownWebhookSource = errors.New("unknown webhook source")
+
+// processWebhookEvent applies an event the caller claimed and records
+// the attempt. Events that failed for a reason that might go away are
+// left pending with their next attempt backed off, until they run out
+// of attempts. It returns the event as recorded and why it failed.
+func (cfg *apiConfig) processWebhookEvent(webhookEvent database.WebhookEvent, now time.Time) (database.WebhookEvent, error) {
+	var recorded database.WebhookEvent
+	var status string
+	var err error
+	switch webhookEvent.Source {
+	case database.WebhookSourcePolka:
+		recorded, status, err = cfg.applyPolka(webhookEvent, now)
+	default:
+		status, err = database.WebhookFailed, errUnknownWebhookSource
+	}
+	if status == database.WebhookProcessed {
+		// recorded along with the change it made
+		return recorded, nil
+	}
+
+	var lastError string
+	var nextAttemptAt *time.Time
+	if err != nil {
+		lastError = err.Error()
+		log.Printf("Error processing webhook event %d: %s", webhookEvent.ID, err)
+	}
+	if status == database.WebhookPending {
+		attempts := webhookEvent.Attempts + 1
+		if attempts >= webhookMaxAttempts {
+			status = database.WebhookFailed
+		} else {
+			next := now.Add(webhookBackoff.delay(attempts))
+			nextAttemptAt = &next
+		}
+	}
+
+	recorded, recordErr := cfg.db.RecordWebhookAttempt(webhookEvent.ID, status, lastError, nextAttemptAt, now)
+	if recordErr != nil {
+		// the claim runs out and the retry job tries it again
+		log.Printf("Error recording attempt of webhook event %d: %s", webhookEvent.ID, recordErr)
+
+		webhookEvent.Status = database.WebhookPending
+		if err == nil {
+			err = recordErr
+		}
+		return webhookEvent, err
+	}
+
+	return recorded, err
+}
+
+// retryWebhookEvents processes the webhook events that are due, those
+// whose last attempt failed and those whose claim ran out
+func (cfg *apiConfig) retryWebhookEvents(now time.Time) {
+	due, err := cfg.db.ClaimDueWebhookEvents(now, now.Add(webhookClaim), webhookRetryBatch)
+	if err != nil {
+		log.Printf("Error claiming webhook events: %s", err)
+	}
+
+	processed := 0
+	for _, webhookEvent := range due {
+		_, err = cfg.processWebhookEvent(webhookEvent, now)
+		if err == nil {
+			processed++
+		}
+	}
+	if len(due) > 0 {
+		log.Printf("retried %d webhook events, %d succeeded", len(due), processed)
+	}
+}
+
+// purgeWebhookEvents deletes the webhook events that were done with
+// and received longer than webhookRetention ago
+func (cfg *apiConfig) purgeWebhookEvents(now time.Time) {
+	n, err := cfg.db.PurgeWebhookEvents(now.Add(-webhookRetention))
+	if err != nil {
+		log.Printf("Error purging webhook events: %s", err)
+	} else if n > 0 {
+		log.Printf("purged %d webhook events", n)
+	}
+}
@@ -1,61 +1,148 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"strings"
+	"slices"
+	"time"
 
+	"github.com/luispinto23/chirpy-new/internal/auth"
 	"github.com/luispinto23/chirpy-new/internal/database"
 )
 
+const (
+	polkaSignatureHeader = "X-Polka-Signature"
+	polkaTimestampHeader = "X-Polka-Timestamp"
+
+	// polkaSignatureTolerance is how far a delivery's timestamp
+	// may be from our clock
+	polkaSignatureTolerance = 5 * time.Minute
+
+	maxWebhookBodyBytes = 1 << 20
+)
+
 type polkaDto struct {
-	Event string `json:"event,omitempty"`
-	Data  struct {
-		UserID int `json:"user_id,omitempty"`
-	} `json:"data,omitempty"`
+	// ID identifies the delivery, a redelivery keeps it
+	ID    string    `json:"id,omitempty"`
+	Event string    `json:"event,omitempty"`
+	Data  polkaData `json:"data,omitempty"`
 }
 
 func (cfg *apiConfig) polka(w http.ResponseWriter, r *http.Request) {
-	apiKeyHeader := r.Header.Get("Authorization")
+	// the signature covers the body exactly as it was sent
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		log.Printf("Error reading body: %s", err)
 
-	if apiKeyHeader == "" {
-		w.WriteHeader(http.StatusUnauthorized)
+		respondWithError(w, http.StatusInternalServerError, "something went wrong")
 		return
 	}
 
-	apiKeyStr := strings.Split(apiKeyHeader, " ")[1]
-	if cfg.polkaApiKey != apiKeyStr {
+	if !cfg.polkaAuthenticated(r, body) {
 		respondWithError(w, http.StatusUnauthorized, "")
 		return
 	}
 
+	// whatever happens next, the delivery is in the inbox first. A signed
+	// body that isn't JSON is kept too, so that it can be inspected.
 	var polka polkaDto
+	_ = json.Unmarshal(body, &polka)
 
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&polka)
+	// the delivery ID is reserved before anything is applied, so of
+	// concurrent redeliveries only the first one gets past here. Only the
+	// id Polka gives a delivery tells a redelivery apart from a new event
+	// with the same body, like the next subscription.renewed, so
+	// deliveries without one are applied every time.
+	webhookEvent, err := cfg.db.ReceiveWebhookEvent(
+		database.WebhookSourcePolka, polka.ID, polka.Event, string(body), time.Now().Add(webhookClaim),
+	)
 	if err != nil {
-		log.Printf("Error decoding body: %s", err)
-
-		respondWithError(w, http.StatusInternalServerError, "something went wrong")
+		// a redelivery of an event we already have, which is ours to retry
+		if errors.Is(err, database.ErrAlreadyExists) {
+			respondWithJSON(w, http.StatusNoContent, nil)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	if polka.Event != "user.upgraded" {
-		respondWithError(w, http.StatusNoContent, "")
-		return
+	webhookEvent, err = cfg.processWebhookEvent(webhookEvent, time.Now())
+	switch {
+	case err == nil:
+		respondWithJSON(w, http.StatusNoContent, nil)
+	case webhookEvent.Status == database.WebhookPending:
+		// stored and retried in the background, Polka needn't redeliver
+		w.WriteHeader(http.StatusAccepted)
+	case errors.Is(err, database.ErrNotFound):
+		respondWithError(w, http.StatusNotFound, err.Error())
+	default:
+		respondWithError(w, http.StatusBadRequest, err.Error())
+	}
+}
+
+// applyPolka applies a Polka event to the subscription it's about,
+// returning the status the event ends up in. A processed event is
+// recorded along with the change it makes and returned as recorded.
+func (cfg *apiConfig) applyPolka(webhookEvent database.WebhookEvent, now time.Time) (database.WebhookEvent, string, error) {
+	var polka polkaDto
+
+	err := json.Unmarshal([]byte(webhookEvent.Payload), &polka)
+	if err != nil {
+		return webhookEvent, database.WebhookFailed, fmt.Errorf("decoding payload: %w", err)
+	}
+
+	if !slices.Contains(polkaEvents, polka.Event) {
+		return webhookEvent, database.WebhookIgnored, nil
 	}
 
-	err = cfg.db.UpgradeUser(polka.Data.UserID)
+	recorded, err := cfg.db.ApplyWebhookEvent(webhookEvent.ID, polka.Data.UserID, func(sub *database.Subscription) error {
+		// as of when it arrived, however late it's retried
+		return cfg.applyPolkaEvent(sub, polka.Event, polka.Data, webhookEvent.ReceivedAt)
+	}, now)
 	if err != nil {
+		if errors.Is(err, database.ErrWebhookProcessed) {
+			// whoever held the claim before it ran out got there first
+			webhookEvent.Status = database.WebhookProcessed
+			if processed, getErr := cfg.db.GetWebhookEvent(webhookEvent.ID); getErr == nil {
+				webhookEvent = processed
+			}
+			return webhookEvent, database.WebhookProcessed, nil
+		}
+		if errors.Is(err, errSubscriptionUnchanged) || errors.Is(err, errStalePolkaEvent) {
+			return webhookEvent, database.WebhookIgnored, nil
+		}
 		if errors.Is(err, database.ErrNotFound) {
-			respondWithError(w, http.StatusNotFound, err.Error())
-			return
+			return webhookEvent, database.WebhookFailed, err
 		}
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
+		return webhookEvent, database.WebhookPending, err
+	}
+
+	return recorded, database.WebhookProcessed, nil
+}
+
+// polkaAuthenticated checks the signature of a delivery when a webhook
+// secret is configured, and falls back to the static API key otherwise
+func (cfg *apiConfig) polkaAuthenticated(r *http.Request, body []byte) bool {
+	if cfg.polkaWebhookSecret != "" {
+		err := auth.VerifyWebhook(cfg.polkaWebhookSecret,
+			r.Header.Get(polkaTimestampHeader), r.Header.Get(polkaSignatureHeader),
+			body, time.Now(), polkaSignatureTolerance)
+		if err != nil {
+			log.Printf("Rejected Polka webhook: %s", err)
+			return false
+		}
+		return true
+	}
+
+	apiKeyStr, err := auth.GetAPIKey(r.Header)
+	if err != nil || cfg.polkaApiKey == "" {
+		return false
 	}
 
-	respondWithJSON(w, http.StatusNoContent, nil)
+	return subtle.ConstantTimeCompare([]byte(cfg.polkaApiKey), []byte(apiKeyStr)) == 1
 }
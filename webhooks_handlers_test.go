@@ -0,0 +1,234 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luispinto23/chirpy-new/internal/auth"
+	"github.com/luispinto23/chirpy-new/internal/database"
+)
+
+// polkaTestConfig returns a config with a fresh store and a user to
+// upgrade, checking webhooks against secret when it's set and the
+// API key "polka-key" otherwise
+func polkaTestConfig(t *testing.T, secret string) (*apiConfig, database.User) {
+	t.Helper()
+
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), database.FlushPolicy{Mode: database.FlushEveryWrite})
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	user, err := db.CreateUser("a@b.com", "hash")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+
+	cfg := &apiConfig{
+		db:                 db,
+		polkaApiKey:        "polka-key",
+		polkaWebhookSecret: secret,
+		subscriptionGrace:  defaultSubscriptionGrace,
+	}
+	return cfg, user
+}
+
+// deliverPolka sends body to the Polka webhook, signed at sentAt when
+// the config has a secret and with the API key otherwise
+func deliverPolka(cfg *apiConfig, body string, sentAt time.Time) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", strings.NewReader(body))
+	if cfg.polkaWebhookSecret != "" {
+		r.Header.Set(polkaTimestampHeader, strconv.FormatInt(sentAt.Unix(), 10))
+		r.Header.Set(polkaSignatureHeader, auth.SignWebhook(cfg.polkaWebhookSecret, sentAt.Unix(), []byte(body)))
+	} else {
+		r.Header.Set("Authorization", "ApiKey "+cfg.polkaApiKey)
+	}
+
+	w := httptest.NewRecorder()
+	cfg.polka(w, r)
+	return w
+}
+
+func TestPolkaDeliveries(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		secret string
+		// bodies are delivered in order, a second apart
+		bodies     []string
+		wantEvents int
+	}{
+		{
+			name:       "key only duplicate delivery",
+			bodies:     []string{`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`, `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`},
+			wantEvents: 1,
+		},
+		{
+			name:       "redelivery with a new timestamp",
+			secret:     "secret",
+			bodies:     []string{`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`, `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`},
+			wantEvents: 1,
+		},
+		{
+			// like a monthly renewal, whose bodies are all the same
+			name:   "signed deliveries without an id are each applied",
+			secret: "secret",
+			bodies: []string{
+				`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`,
+				`{"event":"subscription.renewed","data":{"user_id":1}}`,
+				`{"event":"subscription.renewed","data":{"user_id":1}}`,
+			},
+			wantEvents: 3,
+		},
+		{
+			name:       "key only delivery without an id",
+			bodies:     []string{`{"event":"user.upgraded","data":{"user_id":1}}`},
+			wantEvents: 1,
+		},
+		{
+			name:       "key only deliveries without an id are each applied",
+			bodies:     []string{`{"event":"user.upgraded","data":{"user_id":1}}`, `{"event":"user.upgraded","data":{"user_id":1}}`},
+			wantEvents: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, user := polkaTestConfig(t, tt.secret)
+
+			for i, body := range tt.bodies {
+				w := deliverPolka(cfg, body, now.Add(time.Duration(i)*time.Second))
+				if w.Code != http.StatusNoContent {
+					t.Fatalf("delivery %d: status = %d, want %d: %s", i, w.Code, http.StatusNoContent, w.Body)
+				}
+			}
+
+			webhookEvents, err := cfg.db.ListWebhookEvents("", 0)
+			if err != nil {
+				t.Fatalf("ListWebhookEvents: %s", err)
+			}
+			if len(webhookEvents) != tt.wantEvents {
+				t.Fatalf("got %d webhook events, want %d", len(webhookEvents), tt.wantEvents)
+			}
+			for _, webhookEvent := range webhookEvents {
+				if webhookEvent.Status != database.WebhookProcessed {
+					t.Errorf("webhook event %d is %s, want %s", webhookEvent.ID, webhookEvent.Status, database.WebhookProcessed)
+				}
+			}
+
+			upgraded, err := cfg.db.GetUserByID(user.ID)
+			if err != nil {
+				t.Fatalf("GetUserByID: %s", err)
+			}
+			if !upgraded.IsChirpyRed() {
+				t.Errorf("user wasn't upgraded: %+v", upgraded.Subscription)
+			}
+		})
+	}
+}
+
+func TestPolkaRejectsBadSignature(t *testing.T) {
+	cfg, _ := polkaTestConfig(t, "secret")
+
+	body := `{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`
+	r := httptest.NewRequest(http.MethodPost, "/api/polka/webhooks", strings.NewReader(body))
+	now := time.Now()
+	r.Header.Set(polkaTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	r.Header.Set(polkaSignatureHeader, auth.SignWebhook("other", now.Unix(), []byte(body)))
+
+	w := httptest.NewRecorder()
+	cfg.polka(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	webhookEvents, err := cfg.db.ListWebhookEvents("", 0)
+	if err != nil {
+		t.Fatalf("ListWebhookEvents: %s", err)
+	}
+	if len(webhookEvents) != 0 {
+		t.Errorf("got %d webhook events, want none", len(webhookEvents))
+	}
+}
+
+func TestRetriedPolkaEventsApplyAsOfArrival(t *testing.T) {
+	cfg, user := polkaTestConfig(t, "")
+
+	upgraded, err := cfg.db.ReceiveWebhookEvent(database.WebhookSourcePolka, "evt_1", "user.upgraded",
+		`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`, time.Now())
+	if err != nil {
+		t.Fatalf("ReceiveWebhookEvent: %s", err)
+	}
+
+	// the first attempt failed, the retry job gets to it a day later
+	retried, err := cfg.processWebhookEvent(upgraded, time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("processWebhookEvent: %s", err)
+	}
+	if retried.Status != database.WebhookProcessed {
+		t.Fatalf("retried upgrade is %s, want %s", retried.Status, database.WebhookProcessed)
+	}
+
+	sub := getSubscription(t, cfg, user.ID)
+	wantEnd := upgraded.ReceivedAt.Add(database.SubscriptionPeriod)
+	if !sub.CurrentPeriodEnd.Equal(wantEnd) {
+		t.Errorf("period end = %s, want a period after the upgrade arrived, %s", sub.CurrentPeriodEnd, wantEnd)
+	}
+}
+
+func TestStalePolkaEventsAreIgnored(t *testing.T) {
+	cfg, user := polkaTestConfig(t, "")
+
+	_, err := cfg.db.UpdateSubscription(user.ID, func(sub *database.Subscription) error {
+		sub.Plan = database.PlanChirpyRed
+		sub.Status = database.SubscriptionActive
+		sub.CurrentPeriodEnd = time.Now().Add(database.SubscriptionPeriod)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %s", err)
+	}
+
+	// an upgrade arrives and fails, then the downgrade that followed it
+	// goes through before the upgrade is retried
+	upgraded, err := cfg.db.ReceiveWebhookEvent(database.WebhookSourcePolka, "evt_1", "user.upgraded",
+		`{"id":"evt_1","event":"user.upgraded","data":{"user_id":1}}`, time.Now())
+	if err != nil {
+		t.Fatalf("ReceiveWebhookEvent: %s", err)
+	}
+	w := deliverPolka(cfg, `{"id":"evt_2","event":"user.downgraded","data":{"user_id":1}}`, time.Now())
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("downgrade: status = %d, want %d: %s", w.Code, http.StatusNoContent, w.Body)
+	}
+
+	stale, err := cfg.processWebhookEvent(upgraded, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("processWebhookEvent: %s", err)
+	}
+	if stale.Status != database.WebhookIgnored {
+		t.Errorf("upgrade retried after the downgrade is %s, want %s", stale.Status, database.WebhookIgnored)
+	}
+	if sub := getSubscription(t, cfg, user.ID); sub.Status != database.SubscriptionExpired {
+		t.Errorf("subscription is %s after a stale upgrade, want %s", sub.Status, database.SubscriptionExpired)
+	}
+}
+
+func getSubscription(t *testing.T, cfg *apiConfig, userID int) database.Subscription {
+	t.Helper()
+
+	user, err := cfg.db.GetUserByID(userID)
+	if err != nil {
+		t.Fatalf("GetUserByID: %s", err)
+	}
+	if user.Subscription == nil {
+		t.Fatalf("user %d has no subscription", userID)
+	}
+	return *user.Subscription
+}